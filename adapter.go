@@ -16,9 +16,13 @@ package arangodbadapter
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	arango "github.com/arangodb/go-driver"
 	http "github.com/arangodb/go-driver/http"
@@ -31,6 +35,15 @@ var (
 	ErrTooManyArguments      error = errors.New("policy has too many arguments")
 	ErrInvalidPolicyDocument error = errors.New("db document does not match valid policy")
 	ErrTooManyFields         error = errors.New("unmaped values in remove request")
+	ErrPolicyNotFound        error = errors.New("policy not found in database")
+	ErrPolicyExists          error = errors.New("policy already exists in database")
+	ErrChangeTrackingOff     error = errors.New("change tracking is not enabled")
+	ErrGraphTracking         error = errors.New("graph storage can't be combined with change tracking")
+	ErrGraphPerPType         error = errors.New("graph storage can't be combined with collection per ptype")
+	ErrVersioningPerPType    error = errors.New("policy versioning can't be combined with collection per ptype")
+	ErrGraphSoftDelete       error = errors.New("graph storage can't be combined with soft delete")
+	ErrGraphValidity         error = errors.New("graph storage can't be combined with rule validity")
+	ErrUnscopedIndex         error = errors.New("collection has unique index without scope attributes")
 )
 
 var defaultMapping []string = []string{"PType", "V0", "V1", "V2", "V3", "V4", "V5"}
@@ -47,7 +60,118 @@ type adapter struct {
 	remove         string
 	removeFiltered string
 	collection     arango.Collection
+	client         arango.Client
 	autocreate     bool
+	schemaLevel    arango.CollectionSchemaLevel
+	onInvalid      func(InvalidDocument)
+	arityField     string
+	sectionField   string
+	stableKeys     bool
+	overwriteMode  arango.OverwriteMode
+	batchSize      int
+	stream         bool
+	cursorTTL      time.Duration
+	workers        int
+	queryRange     string
+	tracking       bool
+	liveFilter     string
+	removeAction   string
+	snapshotPath   string
+	onSnapshotErr  func(error)
+	graphVertices  string
+	graphEdges     string
+	graphName      string
+	graphQuery     string
+	graphRemove    string
+	vertices       arango.Collection
+	edges          arango.Collection
+	scope          map[string]string
+	modelField     string
+	modelID        string
+	ptypePrefix    string
+	ptype          string
+	metadataOn     bool
+	metadataFn     func() Metadata
+	auditName      string
+	auditActor     func() string
+	auditKey       []byte
+	audit          arango.Collection
+	versionsName   string
+	versions       arango.Collection
+	softDelete     bool
+	retention      time.Duration
+	validity       bool
+	validityTTL    bool
+
+	initLock       sync.Mutex
+	stateLock      sync.Mutex
+	loadedRevision string
+	syncedAt       int64
+	boundary       int64
+	degraded       bool
+}
+
+// InvalidDocument describes policy document skipped by LoadPolicy in tolerant mode.
+type InvalidDocument struct {
+	// Key is a _key of the offending document
+	Key string
+	// Err is a reason why document has been rejected; it always wraps ErrInvalidPolicyDocument
+	Err error
+}
+
+// Adapter is a casbin persist.Adapter extended with operations specific to ArangoDB.
+type Adapter interface {
+	persist.Adapter
+	// VerifySchema checks every document of policy collection against schema derived
+	// from field mapping and returns list of documents that do not conform to it.
+	VerifySchema() ([]SchemaViolation, error)
+	// RemovePolicyCount works as RemovePolicy but returns number of removed documents instead of
+	// failing when none matched.
+	RemovePolicyCount(sec string, ptype string, rule []string) (int, error)
+	// RemoveFilteredPolicyCount works as RemoveFilteredPolicy and returns number of removed documents.
+	RemoveFilteredPolicyCount(sec string, ptype string, fieldIndex int, fieldValues ...string) (int, error)
+	// RemoveFilteredPolicyRules works as RemoveFilteredPolicy and returns rules that have been removed.
+	RemoveFilteredPolicyRules(sec string, ptype string, fieldIndex int, fieldValues ...string) ([][]string, error)
+	// Changed reports whether policy collection has been modified since last successful LoadPolicy.
+	Changed() (bool, error)
+	// LoadPolicyIfChanged replaces policy of model with one loaded from database if collection has
+	// been modified since last successful load and leaves model untouched otherwise (or if loading
+	// fails). Returns true if policy has been loaded; role links must be rebuilt afterwards.
+	LoadPolicyIfChanged(model model.Model) (bool, error)
+	// Degraded reports whether last LoadPolicy has been served from local snapshot because
+	// database was unavailable. Requires OpSnapshot.
+	Degraded() bool
+	// SyncPolicy applies to model only changes done since previous LoadPolicy or SyncPolicy.
+	// Requires OpChangeTracking.
+	SyncPolicy(model model.Model) error
+	// AddPolicyContext works as AddPolicy and stores metadata attached to context with
+	// ContextWithMetadata. Requires OpMetadata.
+	AddPolicyContext(ctx context.Context, sec string, ptype string, rule []string) error
+	// GetPolicyMetadata returns metadata stored with a rule. Requires OpMetadata.
+	GetPolicyMetadata(sec string, ptype string, rule []string) (Metadata, error)
+	// AuditLog returns up to limit audit log entries recorded after entry with given key, oldest
+	// first. Requires OpAudit.
+	AuditLog(after string, limit int) ([]AuditEntry, error)
+	// VerifyAuditLog checks hash chain of audit log entries and returns ErrAuditTampered if it
+	// is broken. Requires OpAudit.
+	VerifyAuditLog() error
+	// Versions lists stored policy versions, oldest first; rules of versions are not returned.
+	// Requires OpVersioning.
+	Versions() ([]Version, error)
+	// DiffVersions returns rules removed and added between two policy versions.
+	// Requires OpVersioning.
+	DiffVersions(from int, to int) (removed []PolicyRule, added []PolicyRule, err error)
+	// RestoreVersion atomically replaces stored rules with rules of given policy version.
+	// Requires OpVersioning.
+	RestoreVersion(number int) error
+	// UndeletePolicy brings back most recently removed rule if it is still within retention
+	// period. Requires OpSoftDelete.
+	UndeletePolicy(sec string, ptype string, rule []string) error
+	// AddPolicyWithExpiry works as AddPolicy; rule is valid until given time. Requires OpValidity.
+	AddPolicyWithExpiry(sec string, ptype string, rule []string, validUntil time.Time) error
+	// AddPolicyWithValidity works as AddPolicy; rule is valid between given times, zero time
+	// meaning no bound. Requires OpValidity.
+	AddPolicyWithValidity(sec string, ptype string, rule []string, validFrom time.Time, validUntil time.Time) error
 }
 
 type adapterOption func(*adapter)
@@ -90,6 +214,244 @@ func OpFieldMapping(mapping ...string) func(*adapter) {
 	}
 }
 
+// OpArityField configures name of attribute holding number of values of stored rule; default is "Arity".
+// Arity makes rules with empty values (in the middle or at the end) load exactly as they were saved.
+// Empty name disables writing arity - rule length is then inferred from last non empty value.
+func OpArityField(name string) func(*adapter) {
+	return func(a *adapter) {
+		a.arityField = name
+	}
+}
+
+// OpSectionField configures name of attribute holding model section ("p", "g", ...) of stored rule;
+// default is "Section". Empty name disables it and section is derived from first letter of ptype.
+func OpSectionField(name string) func(*adapter) {
+	return func(a *adapter) {
+		a.sectionField = name
+	}
+}
+
+// OpDeterministicKeys makes adapter derive document _key from hash of section, ptype and rule values
+// so the same rule is always stored under the same key. Together with OpOverwriteMode it makes
+// repeated or concurrent writes of the same rule safe; default is false (keys generated by database).
+func OpDeterministicKeys(enabled bool) func(*adapter) {
+	return func(a *adapter) {
+		a.stableKeys = enabled
+	}
+}
+
+// OpOverwriteMode configures what happens when rule being written already exists under the same _key
+// (see OpDeterministicKeys): arango.OverwriteModeIgnore keeps stored document, arango.OverwriteModeReplace
+// replaces it. Default is arango.OverwriteModeConflict which fails with ErrPolicyExists.
+func OpOverwriteMode(mode arango.OverwriteMode) func(*adapter) {
+	return func(a *adapter) {
+		a.overwriteMode = mode
+	}
+}
+
+// OpBatchSize configures number of documents transferred from database in single roundtrip while
+// loading policy; default is 0 which leaves it to driver and server defaults.
+func OpBatchSize(batchSize int) func(*adapter) {
+	return func(a *adapter) {
+		a.batchSize = batchSize
+	}
+}
+
+// OpStreamCursor enables AQL streaming cursors while loading policy: documents are produced lazily
+// as they are read instead of materializing whole result on server first. Recommended for very
+// large collections; default is false.
+func OpStreamCursor(stream bool) func(*adapter) {
+	return func(a *adapter) {
+		a.stream = stream
+	}
+}
+
+// OpCursorTTL configures time after which server removes cursor that is not being read; default
+// is 0 which leaves it to server default.
+func OpCursorTTL(ttl time.Duration) func(*adapter) {
+	return func(a *adapter) {
+		a.cursorTTL = ttl
+	}
+}
+
+// OpParallelLoad splits LoadPolicy into given number of concurrent cursors, each reading different
+// range of document keys. Rules are added to model in order of their keys so result does not depend
+// on timing of cursors. Default is 1 (single cursor, order defined by database).
+func OpParallelLoad(workers int) func(*adapter) {
+	return func(a *adapter) {
+		a.workers = workers
+	}
+}
+
+// OpChangeTracking enables tracking of changes needed by SyncPolicy. Every written document gets
+// "UpdatedAt" attribute set to database time and removed rules are not deleted but turned into
+// tombstones ("DeletedAt" attribute set, ptype moved to attribute prefixed with "Deleted") so
+// other adapter instances may learn about removal. Default is false.
+func OpChangeTracking(enabled bool) func(*adapter) {
+	return func(a *adapter) {
+		a.tracking = enabled
+	}
+}
+
+// OpTombstoneRetention configures how long tombstones (see OpChangeTracking and OpSoftDelete) are
+// kept; after that they are purged by TTL index on "ExpireAt" attribute. SyncPolicy called after
+// longer break than retention may miss removals so it falls back to full LoadPolicy. Default is 0
+// which keeps tombstones forever.
+func OpTombstoneRetention(retention time.Duration) func(*adapter) {
+	return func(a *adapter) {
+		a.retention = retention
+	}
+}
+
+// OpSnapshot configures path of local file where copy of policy is written after every successful
+// LoadPolicy. If database is unavailable (also when adapter is created) policy is loaded from that
+// file instead and adapter is flagged as degraded until next successful load from database. Errors
+// of writing snapshot do not fail LoadPolicy; they are reported to onError (which may be nil).
+// Default is no snapshot.
+func OpSnapshot(path string, onError func(error)) func(*adapter) {
+	return func(a *adapter) {
+		a.snapshotPath = path
+		if onError == nil {
+			onError = func(error) {}
+		}
+		a.onSnapshotErr = onError
+	}
+}
+
+// OpGraphStorage stores grouping rules ("g" section) as edges of edgeCollection connecting vertices
+// of vertexCollection which represent users and roles, so role membership may be queried and
+// visualized natively in ArangoDB. Edge leads from first to second value of rule and keeps all its
+// values as regular policy document does. Adapter loads and saves such rules transparently.
+// Default is "" for both names which keeps grouping rules in policy collection.
+func OpGraphStorage(vertexCollection, edgeCollection string) func(*adapter) {
+	return func(a *adapter) {
+		a.graphVertices = vertexCollection
+		a.graphEdges = edgeCollection
+	}
+}
+
+// OpGraphName configures name of named graph built (in autocreate mode) over collections
+// configured with OpGraphStorage; default is "" which creates no named graph.
+func OpGraphName(name string) func(*adapter) {
+	return func(a *adapter) {
+		a.graphName = name
+	}
+}
+
+// OpScope restricts adapter to documents having all given attributes set to given values, so many
+// tenants may keep their policies in one collection. Attributes are written to every document and
+// all queries (SavePolicy included) touch only matching documents. Scope attributes become part
+// of unique index as well; if collection still has unique index created without them (e.g. by
+// unscoped adapter) adapter fails with ErrUnscopedIndex as such index would reject the same rule
+// of second scope. Default is no scope.
+func OpScope(scope map[string]string) func(*adapter) {
+	copied := make(map[string]string, len(scope))
+	for name, value := range scope {
+		copied[name] = value
+	}
+	return func(a *adapter) {
+		a.scope = copied
+	}
+}
+
+// OpModelID makes adapter keep only rules of model with given identifier so policies of different
+// casbin models (e.g. RBAC of API and ABAC of data) may be stored in one collection. Identifier is
+// written to attribute configured with OpModelField and works as additional OpScope attribute:
+// each adapter loads, removes and replaces (in SavePolicy) only documents of its own model.
+// Default is "" - all documents belong to one model.
+func OpModelID(id string) func(*adapter) {
+	return func(a *adapter) {
+		a.modelID = id
+	}
+}
+
+// OpModelField configures name of attribute holding model identifier; default is "Model".
+func OpModelField(name string) func(*adapter) {
+	return func(a *adapter) {
+		a.modelField = name
+	}
+}
+
+// OpCollectionPerPType makes adapter store rules of every ptype in separate collection named with
+// given prefix followed by ptype (e.g. "casbin_p", "casbin_g"), so each of them may have its own
+// indexes and sharding. Collections are created as new ptypes appear (in autocreate mode) and
+// LoadPolicy reads collections of all ptypes defined in model. Snapshot (see OpSnapshot) is kept
+// per ptype in file with ptype appended to path. OpCollectionName is ignored; default is "" which
+// keeps all rules in one collection.
+func OpCollectionPerPType(prefix string) func(*adapter) {
+	return func(a *adapter) {
+		a.ptypePrefix = prefix
+	}
+}
+
+// OpMetadata enables rule metadata (see Metadata) stored with every rule added by AddPolicy,
+// AddPolicyContext or SavePolicy and read back with GetPolicyMetadata. Provider (which may be nil)
+// supplies metadata of rules added without metadata in context. SavePolicy keeps metadata of rules
+// that were already stored. Default is no metadata.
+func OpMetadata(provider func() Metadata) func(*adapter) {
+	return func(a *adapter) {
+		a.metadataOn = true
+		a.metadataFn = provider
+	}
+}
+
+// OpAudit enables audit log: every change made by AddPolicy, RemovePolicy, RemoveFilteredPolicy
+// and SavePolicy is recorded (see AuditEntry) in collection of given name, in the same transaction
+// as the change itself. Actor (which may be nil) identifies author of changes made without
+// metadata in context (see ContextWithMetadata). Entries are chained with hashes so accidental or
+// partial edits may be detected with VerifyAuditLog; see OpAuditKey to detect deliberate ones.
+// Default is no audit log.
+func OpAudit(collectionName string, actor func() string) func(*adapter) {
+	return func(a *adapter) {
+		a.auditName = collectionName
+		a.auditActor = actor
+	}
+}
+
+// OpAuditKey makes audit log entries signed with HMAC-SHA256 using given secret key instead of
+// plain SHA-256 hash, so VerifyAuditLog detects entries modified, removed or inserted by anyone
+// not knowing the key, even if hashes of following entries are recomputed. Key must be the same
+// for all adapters sharing audit log and must not be stored in the database. Requires OpAudit.
+// Default is no key.
+func OpAuditKey(key []byte) func(*adapter) {
+	return func(a *adapter) {
+		a.auditKey = key
+	}
+}
+
+// OpVersioning enables policy versioning: every SavePolicy stores saved rules as new numbered
+// version in collection of given name (preceded by version of replaced rules if they have been
+// changed since newest version). Versions may be listed, compared and restored. Default is no
+// versioning.
+func OpVersioning(collectionName string) func(*adapter) {
+	return func(a *adapter) {
+		a.versionsName = collectionName
+	}
+}
+
+// OpSoftDelete makes RemovePolicy, RemoveFilteredPolicy and SavePolicy turn removed rules into
+// tombstones (as OpChangeTracking does) instead of deleting them. Tombstones are not loaded and
+// may be brought back with UndeletePolicy within retention period set by OpTombstoneRetention;
+// after it they are purged by TTL index on "ExpireAt" attribute. Default is hard delete.
+func OpSoftDelete() func(*adapter) {
+	return func(a *adapter) {
+		a.softDelete = true
+	}
+}
+
+// OpValidity enables rules with validity window (see AddPolicyWithValidity): rules are loaded
+// only between their "ValidFrom" and "ValidUntil" times; SavePolicy keeps rules that are not
+// valid yet and windows of rules it writes again. Expired rules are removed (or turned into
+// tombstones) by next change. With ttl set expired rules are also purged by TTL index on
+// "ExpireAt" attribute; tombstones of removed rules are purged according to tombstone retention
+// instead. Default is no validity windows.
+func OpValidity(ttl bool) func(*adapter) {
+	return func(a *adapter) {
+		a.validity = true
+		a.validityTTL = ttl
+	}
+}
+
 // OpAutocreate enables autocreate mode - both database and collection will be created
 // by adapter if not exist. Should be used with care as each structure is created with
 // driver default options set.
@@ -99,21 +461,122 @@ func OpAutocreate(autocreate bool) func(*adapter) {
 	}
 }
 
+// OpSchemaValidation installs JSON schema rule derived from field mapping on policy collection
+// so malformed documents are rejected by database on write. Level controls how strictly rule is
+// enforced; default is arango.CollectionSchemaLevelNone which leaves collection schema untouched.
+func OpSchemaValidation(level arango.CollectionSchemaLevel) func(*adapter) {
+	return func(a *adapter) {
+		a.schemaLevel = level
+	}
+}
+
+// OpTolerantLoad enables tolerant mode of LoadPolicy: documents that can't be converted into policy
+// rule are skipped instead of aborting whole load. Each skipped document is reported to callback
+// (which may be nil if not interested). By default LoadPolicy fails on first invalid document.
+func OpTolerantLoad(callback func(InvalidDocument)) func(*adapter) {
+	return func(a *adapter) {
+		if callback == nil {
+			callback = func(InvalidDocument) {}
+		}
+		a.onInvalid = callback
+	}
+}
+
 // NewAdapter creates new instance of adapter. If called with no argument default options are applied.
 // Options may reconfigure all or some parameters to different values. See description of each Option
 // for details.
-func NewAdapter(options ...adapterOption) (persist.Adapter, error) {
+func NewAdapter(options ...adapterOption) (Adapter, error) {
+	a, err := newAdapter(options...)
+	if err != nil {
+		return nil, err
+	}
+	client, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	return openAdapter(client, a, options)
+}
+
+// openAdapter opens adapter configured by options using given client. Adapter a must be
+// configured with the same options.
+func openAdapter(client arango.Client, a *adapter, options []adapterOption) (Adapter, error) {
+	if a.ptypePrefix != "" {
+		return newPTypeRouter(client, a, options), nil
+	}
+	a.client = client
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// newAdapter returns adapter configured with defaults overridden by options. It is not connected
+// to database yet.
+func newAdapter(options ...adapterOption) (*adapter, error) {
 	a := adapter{}
 	a.dbName = "casbin"
 	a.collectionName = "casbin_rules"
 	a.mapping = defaultMapping
 	a.endpoints = []string{"http://127.0.0.1:8529"}
 	a.autocreate = true
+	a.schemaLevel = arango.CollectionSchemaLevelNone
+	a.arityField = "Arity"
+	a.sectionField = "Section"
+	a.overwriteMode = arango.OverwriteModeConflict
+	a.workers = 1
+	a.modelField = "Model"
 
 	for _, option := range options {
 		option(&a)
 	}
+	if a.modelID != "" {
+		scope := make(map[string]string, len(a.scope)+1)
+		for name, value := range a.scope {
+			scope[name] = value
+		}
+		scope[a.modelField] = a.modelID
+		a.scope = scope
+	}
+	if a.graphEdges != "" && a.tracking {
+		return nil, ErrGraphTracking
+	}
+	if a.graphEdges != "" && a.softDelete {
+		return nil, ErrGraphSoftDelete
+	}
+	if a.graphEdges != "" && a.validity {
+		return nil, ErrGraphValidity
+	}
+	if a.graphEdges != "" && a.ptypePrefix != "" {
+		return nil, ErrGraphPerPType
+	}
+	if a.versionsName != "" && a.ptypePrefix != "" {
+		return nil, ErrVersioningPerPType
+	}
+
+	a.liveFilter = a.scopeFilter("d")
+	a.removeAction = fmt.Sprintf("REMOVE d IN %s", a.collectionName)
+	if a.tombstones() {
+		a.liveFilter = fmt.Sprintf("%s && d.%s == null", a.liveFilter, deletedAtField)
+		a.removeAction = a.tombstoneAction()
+	}
+
+	loadFilter := a.liveFilter
+	if a.validity {
+		loadFilter = fmt.Sprintf("%s && %s", loadFilter, a.validityFilter("d"))
+	}
+
+	a.query = fmt.Sprintf("FOR d IN %s FILTER %s RETURN %s", a.collectionName, loadFilter, a.projection("d"))
+	a.queryRange = fmt.Sprintf("FOR d IN %s FILTER %s && %s SORT d._key RETURN %s", a.collectionName, loadFilter, "%s", a.projection("d"))
+	a.remove = fmt.Sprintf("FOR d IN %s FILTER %s && %s %s", a.collectionName, a.scopeFilter("d"), "%s", a.removeAction)
+	a.removeFiltered = fmt.Sprintf("FOR d IN %s FILTER %s && %s %s", a.collectionName, a.scopeFilter("d"), "%s", a.removeAction)
+	a.graphQuery = fmt.Sprintf("FOR d IN %s FILTER %s RETURN %s", a.graphEdges, a.scopeFilter("d"), a.projection("d"))
+	a.graphRemove = fmt.Sprintf("FOR d IN %s FILTER %s && %s REMOVE d IN %s", a.graphEdges, a.scopeFilter("d"), "%s", a.graphEdges)
+	return &a, nil
+}
 
+// connect creates client of database configured by endpoints and credentials of adapter.
+func (a *adapter) connect() (arango.Client, error) {
 	conn, err := http.NewConnection(http.ConnectionConfig{
 		Endpoints: a.endpoints,
 	})
@@ -127,212 +590,855 @@ func NewAdapter(options ...adapterOption) (persist.Adapter, error) {
 			return nil, err
 		}
 	}
-	c, err := arango.NewClient(
+	return arango.NewClient(
 		arango.ClientConfig{
 			Connection: conn,
 		},
 	)
+}
+
+// open initializes database structures of connected adapter. Failure caused by unavailable
+// database is tolerated if there is snapshot policy may be loaded from.
+func (a *adapter) open() error {
+	err := a.initialize()
 	if err != nil {
-		return nil, err
+		if a.snapshotPath == "" || !isUnavailable(err) {
+			return err
+		}
+		// database is set up on first successful operation; until then policy is loaded from snapshot
+		a.degraded = true
 	}
+	return nil
+}
 
+// initialize prepares database, collection and indexes used by adapter. Collection is set
+// only when all steps succeed so it may be retried later (see ensureReady).
+func (a *adapter) initialize() error {
 	if a.autocreate {
-		ex, err := c.DatabaseExists(context.Background(), a.dbName)
+		ex, err := a.client.DatabaseExists(context.Background(), a.dbName)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if !ex {
-			_, err := c.CreateDatabase(context.Background(), a.dbName, nil)
+			_, err := a.client.CreateDatabase(context.Background(), a.dbName, nil)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	db, err := c.Database(context.Background(), a.dbName)
+	db, err := a.client.Database(context.Background(), a.dbName)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	a.database = db
 
-	var queryResult []string = make([]string, 0, len(a.mapping))
+	col, err := a.ensureCollection(a.collectionName, nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = col.EnsureHashIndex(context.Background(),
+		a.indexFields(), &arango.EnsureHashIndexOptions{
+			Unique: true,
+			Sparse: true,
+		})
+	if err != nil {
+		return err
+	}
+	if err = a.checkScopedIndexes(col); err != nil {
+		return err
+	}
+	if a.tracking {
+		_, _, err = col.EnsurePersistentIndex(context.Background(),
+			[]string{updatedAtField}, &arango.EnsurePersistentIndexOptions{
+				Sparse: true,
+			})
+		if err != nil {
+			return err
+		}
+	}
+	if a.validity {
+		_, _, err = col.EnsurePersistentIndex(context.Background(),
+			[]string{validUntilField}, &arango.EnsurePersistentIndexOptions{
+				Sparse: true,
+			})
+		if err != nil {
+			return err
+		}
+	}
+	if a.expiring() {
+		_, _, err = col.EnsureTTLIndex(context.Background(), expireAtField, 0, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if a.schemaLevel != arango.CollectionSchemaLevelNone {
+		err = col.SetProperties(context.Background(), arango.SetCollectionPropertiesOptions{
+			Schema: a.schema(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if a.graphEdges != "" {
+		if err = a.initializeGraph(); err != nil {
+			return err
+		}
+	}
+	if a.auditName != "" {
+		if err = a.initializeAudit(); err != nil {
+			return err
+		}
+	}
+	if a.versionsName != "" {
+		if err = a.initializeVersions(); err != nil {
+			return err
+		}
+	}
+	a.collection = col
+	return nil
+}
+
+// policyLine is a single rule decoded from policy document.
+type policyLine struct {
+	sec   string
+	ptype string
+	rule  []string
+}
+
+// projection returns AQL expression reading attributes of document v as an array laid out
+// as expected by decodePolicyLine: _key, mapped fields, arity and section. Arrays are used
+// instead of objects so rows can be decoded into single reused slice.
+func (a *adapter) projection(v string) string {
+	fields := make([]string, 0, len(a.mapping)+3)
+	fields = append(fields, v+"._key")
+	for _, name := range a.mapping {
+		fields = append(fields, v+"."+name)
+	}
+	for _, name := range []string{a.arityField, a.sectionField} {
+		if name == "" {
+			fields = append(fields, "null")
+		} else {
+			fields = append(fields, v+"."+name)
+		}
+	}
+	return "[" + strings.Join(fields, ",") + "]"
+}
 
-	for _, v := range a.mapping {
-		queryResult = append(queryResult, `"`+v+`":d.`+v)
+func (a *adapter) decodePolicyLine(row []interface{}) (policyLine, error) {
+	if len(row) != len(a.mapping)+3 {
+		return policyLine{}, fmt.Errorf("%w: unexpected number of attributes", ErrInvalidPolicyDocument)
 	}
+	values := row[2 : len(a.mapping)+1]
+	arityValue, secValue := row[len(a.mapping)+1], row[len(a.mapping)+2]
 
-	a.query = fmt.Sprintf("FOR d IN %s RETURN {%s}", a.collectionName, strings.Join(queryResult, ","))
-	a.remove = fmt.Sprintf("FOR d IN %s FILTER %s REMOVE d IN %s", a.collectionName, "%s", a.collectionName)
-	a.removeFiltered = fmt.Sprintf("FOR d IN %s FILTER %s REMOVE d IN %s", a.collectionName, "%s", a.collectionName)
+	ptype, ok := row[1].(string)
+	if !ok || ptype == "" {
+		return policyLine{}, fmt.Errorf("%w: missing %s", ErrInvalidPolicyDocument, a.mapping[0])
+	}
 
-	if a.autocreate {
-		exists, err := db.CollectionExists(context.Background(), a.collectionName)
-		if err != nil {
-			return nil, err
+	sec := ptype[:1]
+	if secValue != nil {
+		sec, ok = secValue.(string)
+		if !ok || sec == "" {
+			return policyLine{}, fmt.Errorf("%w: invalid %s", ErrInvalidPolicyDocument, a.sectionField)
 		}
-		if !exists {
-			_, err := db.CreateCollection(context.Background(), a.collectionName, nil)
-			// 1207 is ERROR_ARANGO_DUPLICATE_NAME - driver has no symbolic wrapper for it for now
-			// ignores error that may happen if collection has been created in the meantime
-			if err != nil && arango.IsArangoErrorWithErrorNum(err, 1207) {
-				return nil, err
+	}
+
+	last := -1
+	for i, value := range values {
+		switch value := value.(type) {
+		case nil:
+		case string:
+			if value != "" {
+				last = i
 			}
+		default:
+			return policyLine{}, fmt.Errorf("%w: field %s is not a string", ErrInvalidPolicyDocument, a.mapping[i+1])
+		}
+	}
+
+	arity := last + 1
+	if arityValue != nil {
+		n, ok := arityValue.(float64)
+		if !ok || n != float64(int(n)) || n < 1 || int(n) > len(values) {
+			return policyLine{}, fmt.Errorf("%w: invalid %s", ErrInvalidPolicyDocument, a.arityField)
+		}
+		arity = int(n)
+	}
+	if arity == 0 {
+		return policyLine{}, fmt.Errorf("%w: no rule values", ErrInvalidPolicyDocument)
+	}
+
+	rule := make([]string, arity)
+	for i := range rule {
+		rule[i], _ = values[i].(string)
+	}
+	return policyLine{sec: sec, ptype: ptype, rule: rule}, nil
+}
+
+func (a *adapter) loadPolicyLine(line policyLine, model model.Model) error {
+	if _, ok := model[line.sec][line.ptype]; !ok {
+		return fmt.Errorf("%w: ptype %s is not defined in section %s of model", ErrInvalidPolicyDocument, line.ptype, line.sec)
+	}
+	// model.AddPolicy keeps policy index used by model.HasPolicy up to date which is
+	// required to apply incremental changes later on
+	if !model.HasPolicy(line.sec, line.ptype, line.rule) {
+		model.AddPolicy(line.sec, line.ptype, line.rule)
+	}
+	return nil
+}
+
+// LoadPolicy loads policy from database.
+func (a *adapter) LoadPolicy(model model.Model) error {
+	err := a.loadPolicyFromDatabase(model)
+	if err != nil && a.snapshotPath != "" && isUnavailable(err) {
+		if a.loadSnapshot(model) != nil {
+			return wrapError(LoadOperation, "", nil, err)
 		}
+		a.setDegraded(true)
+		return nil
 	}
-	col, err := db.Collection(context.Background(), a.collectionName)
 	if err != nil {
-		return nil, err
+		return wrapError(LoadOperation, "", nil, err)
 	}
-	a.collection = col
-	_, _, err = a.collection.EnsureHashIndex(context.Background(),
-		a.mapping, &arango.EnsureHashIndexOptions{
-			Unique: true,
-			Sparse: true,
-		})
+	if a.snapshotPath != "" {
+		a.setDegraded(false)
+		if err := a.writeSnapshot(model); err != nil {
+			a.onSnapshotErr(err)
+		}
+	}
+	return nil
+}
+
+func (a *adapter) loadPolicyFromDatabase(model model.Model) error {
+	if err := a.ensureReady(); err != nil {
+		return err
+	}
+	// revision is read before loading so any change done in the meantime is detected by next check
+	revision, err := a.revision()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &a, nil
+	var now int64
+	if a.tracking {
+		now, err = a.serverTime()
+		if err != nil {
+			return err
+		}
+	}
+	var boundary int64
+	if a.validity {
+		boundary, err = a.nextBoundary(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+	err = a.loadPolicy(model)
+	if err != nil {
+		return err
+	}
+	a.stateLock.Lock()
+	a.loadedRevision = revision
+	a.syncedAt = now
+	a.boundary = boundary
+	a.stateLock.Unlock()
+	return nil
 }
 
-func (a *adapter) loadPolicyLine(line map[string]string, model model.Model) error {
-	key := line[a.mapping[0]]
-	if key == "" {
-		return ErrInvalidPolicyDocument
+// Changed reports whether policy collection has been modified since last successful LoadPolicy.
+// Any write to collection counts as modification, including ones done by this adapter. With rule
+// validity (see OpValidity) policy is also reported as changed once validity window of any rule
+// has begun or ended since.
+func (a *adapter) Changed() (bool, error) {
+	if err := a.ensureReady(); err != nil {
+		return false, wrapError(LoadOperation, "", nil, err)
 	}
-	sec := key[:1]
+	revision, err := a.revision()
+	if err != nil {
+		return false, wrapError(LoadOperation, "", nil, err)
+	}
+	a.stateLock.Lock()
+	loadedRevision, boundary := a.loadedRevision, a.boundary
+	a.stateLock.Unlock()
+	if loadedRevision == "" || loadedRevision != revision {
+		return true, nil
+	}
+	if boundary == 0 {
+		return false, nil
+	}
+	// boundary is in database time, same as validity of rules
+	now, err := a.serverTime()
+	if err != nil {
+		return false, wrapError(LoadOperation, "", nil, err)
+	}
+	return now >= boundary, nil
+}
 
-	tokens := []string{}
+// LoadPolicyIfChanged replaces policy of model with one loaded from database unless collection
+// revision is the same as during last successful load. Returns true if policy has been loaded;
+// role links of enforcer using model must be rebuilt by caller afterwards.
+func (a *adapter) LoadPolicyIfChanged(model model.Model) (bool, error) {
+	changed, err := a.Changed()
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, reloadPolicy(model, a.ptype, a.LoadPolicy)
+}
 
-	for _, name := range a.mapping[1:] {
-		value, ok := line[name]
-		if !ok || value == "" {
-			break
+// reloadPolicy replaces policy of model (or only rules of given ptype if it is not empty) with
+// one read by load. Policy is loaded into a copy of model so model keeps its previous policy if
+// loading fails.
+func reloadPolicy(m model.Model, only string, load func(model.Model) error) error {
+	loaded := m.Copy()
+	loaded.ClearPolicy()
+	if err := load(loaded); err != nil {
+		return err
+	}
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range loaded[sec] {
+			if only != "" && ptype != only {
+				continue
+			}
+			m[sec][ptype].Policy = ast.Policy
+			m[sec][ptype].PolicyMap = ast.PolicyMap
 		}
-		tokens = append(tokens, value)
 	}
-	if len(tokens) == 0 {
-		return ErrInvalidPolicyDocument
+	return nil
+}
+
+// queryContext returns context configuring cursors used to read policy.
+func (a *adapter) queryContext(ctx context.Context) context.Context {
+	if a.batchSize > 0 {
+		ctx = arango.WithQueryBatchSize(ctx, a.batchSize)
+	}
+	if a.stream {
+		ctx = arango.WithQueryStream(ctx, true)
+	}
+	if a.cursorTTL > 0 {
+		ctx = arango.WithQueryTTL(ctx, a.cursorTTL)
 	}
+	return ctx
+}
 
-	model[sec][key].Policy = append(model[sec][key].Policy, tokens)
-	return nil
+func (a *adapter) loadPolicy(model model.Model) error {
+	apply := func(key string, line policyLine, err error) error {
+		return a.applyPolicyLine(model, key, line, err)
+	}
+	var err error
+	if a.workers > 1 {
+		err = a.loadPolicyParallel(model)
+	} else {
+		err = a.readPolicy(context.Background(), a.query, nil, apply)
+	}
+	if err != nil || a.edges == nil {
+		return err
+	}
+	return a.readPolicy(context.Background(), a.graphQuery, nil, apply)
 }
 
-// LoadPolicy loads policy from database.
-func (a *adapter) LoadPolicy(model model.Model) error {
-	cursor, err := a.database.Query(context.Background(), a.query, nil)
+// readPolicy runs query returning rows built by projection and passes each of them, decoded,
+// to fn. Decoding errors are passed to fn as well so caller decides whether to abort or not.
+func (a *adapter) readPolicy(ctx context.Context, query string, bindings map[string]interface{}, fn func(key string, line policyLine, err error) error) error {
+	ctx = a.queryContext(ctx)
+	cursor, err := a.database.Query(ctx, query, bindings)
 	if err != nil {
 		return err
 	}
 	defer cursor.Close()
 
+	var row []interface{}
 	for {
-		var doc map[string]string = make(map[string]string)
-		_, err := cursor.ReadDocument(context.Background(), &doc)
+		_, err := cursor.ReadDocument(ctx, &row)
 		if arango.IsNoMoreDocuments(err) {
 			break
 		} else if err != nil {
 			return err
 		}
-		err = a.loadPolicyLine(doc, model)
-		if err != nil {
+		var key string
+		if len(row) > 0 {
+			key, _ = row[0].(string)
+		}
+		line, err := a.decodePolicyLine(row)
+		if err = fn(key, line, err); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (a *adapter) savePolicyLine(ptype string, rule []string) (map[string]string, error) {
+// applyPolicyLine adds decoded line to model. Invalid documents are reported and skipped
+// in tolerant mode.
+func (a *adapter) applyPolicyLine(model model.Model, key string, line policyLine, err error) error {
+	if err == nil {
+		err = a.loadPolicyLine(line, model)
+	}
+	if err != nil && a.onInvalid != nil && errors.Is(err, ErrInvalidPolicyDocument) {
+		a.onInvalid(InvalidDocument{Key: key, Err: err})
+		return nil
+	}
+	return err
+}
+
+func (a *adapter) savePolicyLine(sec string, ptype string, rule []string) (map[string]interface{}, error) {
 	if 1+len(rule) > len(a.mapping) {
 		return nil, ErrTooManyArguments
 	}
-	ruleList := make(map[string]string, len(a.mapping))
+	ruleList := make(map[string]interface{}, len(a.mapping)+2)
 	ruleList[a.mapping[0]] = ptype
 	for i, v := range rule {
 		ruleList[a.mapping[i+1]] = v
 	}
+	if a.arityField != "" {
+		ruleList[a.arityField] = len(rule)
+	}
+	if a.sectionField != "" {
+		ruleList[a.sectionField] = sec
+	}
+	a.stampScope(ruleList)
+	if a.stableKeys {
+		ruleList["_key"] = a.documentKey(sec, ptype, rule)
+	}
+	if a.isGraphSection(sec) {
+		if err := a.linkEdge(ruleList, rule); err != nil {
+			return nil, err
+		}
+	}
 	return ruleList, nil
 }
 
+// policyKey computes stable document key of a rule. Each part is length prefixed so different
+// rules (e.g. ["a,b"] and ["a", "b"]) can never produce the same input for hash function.
+func policyKey(sec string, ptype string, rule []string) string {
+	return hashKey(append([]string{sec, ptype}, rule...)...)
+}
+
+// documentKey returns _key of document storing a rule: policyKey made distinct for every scope.
+func (a *adapter) documentKey(sec string, ptype string, rule []string) string {
+	if len(a.scope) == 0 {
+		return policyKey(sec, ptype, rule)
+	}
+	return hashKey(append(a.scopeValues(), policyKey(sec, ptype, rule))...)
+}
+
+// hashKey returns hex encoded hash of given parts usable as document _key.
+func hashKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:%s;", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// transaction runs fn in stream transaction covering all collections written by adapter, so
+// change, its audit entry and policy version are stored together or not at all. Without audit
+// log and versioning fn is simply called with given context.
+func (a *adapter) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if a.auditName == "" && a.versionsName == "" {
+		return fn(ctx)
+	}
+	cols := arango.TransactionCollections{Write: []string{a.collectionName}}
+	if a.auditName != "" {
+		// audit entries are chained so they must be written one transaction after another
+		cols.Exclusive = append(cols.Exclusive, a.auditName)
+	}
+	if a.versionsName != "" {
+		cols.Write = append(cols.Write, a.versionsName)
+	}
+	if a.edges != nil {
+		cols.Write = append(cols.Write, a.graphEdges, a.graphVertices)
+	}
+	tid, err := a.database.BeginTransaction(ctx, cols, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(arango.WithTransactionID(ctx, tid)); err != nil {
+		if abortErr := a.database.AbortTransaction(ctx, tid, nil); abortErr != nil {
+			return fmt.Errorf("%w (abort failed: %v)", err, abortErr)
+		}
+		return err
+	}
+	return a.database.CommitTransaction(ctx, tid, nil)
+}
+
+// writeContext returns context configuring how documents with already existing keys are handled.
+func (a *adapter) writeContext(ctx context.Context) context.Context {
+	if a.overwriteMode == arango.OverwriteModeConflict {
+		return ctx
+	}
+	return arango.WithOverwriteMode(ctx, a.overwriteMode)
+}
+
 // SavePolicy saves policy to database.
 func (a *adapter) SavePolicy(model model.Model) error {
-	var lines []interface{}
+	return wrapError(SaveOperation, "", nil, a.savePolicy(model))
+}
 
-	for ptype, ast := range model["p"] {
-		for _, rule := range ast.Policy {
-			line, err := a.savePolicyLine(ptype, rule)
-			if err != nil {
-				return err
+func (a *adapter) savePolicy(model model.Model) error {
+	if err := a.ensureReady(); err != nil {
+		return err
+	}
+	var lines []policyLine
+
+	for sec, assertions := range model {
+		for ptype, ast := range assertions {
+			for _, rule := range ast.Policy {
+				lines = append(lines, policyLine{sec: sec, ptype: ptype, rule: rule})
 			}
-			lines = append(lines, &line)
 		}
 	}
+	return a.saveLines(lines, nil)
+}
 
-	for ptype, ast := range model["g"] {
-		for _, rule := range ast.Policy {
-			line, err := a.savePolicyLine(ptype, rule)
+// saveLines replaces all rules stored by adapter with given lines. Validity attributes (keyed by
+// policyKey, see storedValidity) are set on saved rules; nil keeps validity of stored rules.
+func (a *adapter) saveLines(lines []policyLine, validity map[string]interface{}) error {
+	return a.transaction(context.Background(), func(ctx context.Context) error {
+		if a.validity && validity == nil {
+			stored, err := a.storedValidity(ctx)
 			if err != nil {
 				return err
 			}
-			lines = append(lines, &line)
+			validity = stored
+		}
+		if a.auditName != "" || a.versionsName != "" {
+			stored, err := a.storedRules(ctx)
+			if err != nil {
+				return err
+			}
+			saved := withValidity(policyRules(lines), validity)
+			if a.auditName != "" {
+				if err = a.auditSave(ctx, stored, saved); err != nil {
+					return err
+				}
+			}
+			if a.versionsName != "" {
+				if err = a.recordVersions(ctx, stored, saved); err != nil {
+					return err
+				}
+			}
 		}
+		return a.replaceLines(ctx, lines, validity)
+	})
+}
+
+func (a *adapter) replaceLines(ctx context.Context, lines []policyLine, validity map[string]interface{}) error {
+	if a.validity {
+		if err := a.retireExpired(ctx); err != nil {
+			return err
+		}
+	}
+	if a.tombstones() {
+		return a.savePolicyTracked(ctx, lines, validity)
+	}
+	var links []policyLine
+	if a.edges != nil {
+		rules := lines[:0:0]
+		for _, l := range lines {
+			if a.isGraphSection(l.sec) {
+				links = append(links, l)
+			} else {
+				rules = append(rules, l)
+			}
+		}
+		lines = rules
+	}
+	docs, err := a.policyDocuments(lines)
+	if err != nil {
+		return err
+	}
+	edges, err := a.policyDocuments(links)
+	if err != nil {
+		return err
+	}
+	if a.metadataOn {
+		stored, err := a.storedMetadata(ctx)
+		if err != nil {
+			return err
+		}
+		a.attachMetadata(lines, docs, stored)
+		a.attachMetadata(links, edges, stored)
+	}
+	if a.validity {
+		attachValidity(lines, docs, validity)
+		// rules that are not valid yet are not loaded so they are kept
+		err = a.execute(ctx, fmt.Sprintf("FOR d IN %s FILTER %s && !(%s) REMOVE d IN %s",
+			a.collectionName, a.scopeFilter("d"), a.pendingFilter("d"), a.collectionName), nil)
+	} else {
+		err = a.clearCollection(ctx, a.collection)
 	}
-	err := a.collection.Truncate(context.Background())
 	if err != nil {
 		return err
 	}
-	_, _, err = a.collection.CreateDocuments(context.Background(), lines)
+	_, errs, err := a.collection.CreateDocuments(a.writeContext(ctx), docs)
+	if err != nil {
+		return err
+	}
+	if err = errs.FirstNonNil(); err != nil || a.edges == nil {
+		return err
+	}
+	if err = a.clearCollection(ctx, a.edges); err != nil {
+		return err
+	}
+	// vertices may be shared by edges of other scopes
+	if len(a.scope) == 0 {
+		if err = a.vertices.Truncate(ctx); err != nil {
+			return err
+		}
+	}
+	_, err = a.writeEdges(a.writeContext(ctx), links, edges)
 	return err
 }
 
+// policyDocuments converts lines into documents ready to be written to database.
+func (a *adapter) policyDocuments(lines []policyLine) ([]interface{}, error) {
+	docs := make([]interface{}, 0, len(lines))
+	for _, l := range lines {
+		doc, err := a.savePolicyLine(l.sec, l.ptype, l.rule)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
 // AddPolicy adds a policy rule to the storage.
 func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
-	line, err := a.savePolicyLine(ptype, rule)
+	return a.AddPolicyContext(context.Background(), sec, ptype, rule)
+}
+
+// AddPolicyContext works as AddPolicy. Metadata attached to context with ContextWithMetadata
+// is stored with the rule if adapter has been configured with OpMetadata.
+func (a *adapter) AddPolicyContext(ctx context.Context, sec string, ptype string, rule []string) error {
+	return a.addPolicy(ctx, sec, ptype, rule, nil)
+}
+
+// addPolicy adds a rule stored in document with given extra attributes.
+func (a *adapter) addPolicy(ctx context.Context, sec string, ptype string, rule []string, extra map[string]interface{}) error {
+	line, err := a.savePolicyLine(sec, ptype, rule)
+	if err == nil {
+		err = a.ensureReady()
+	}
 	if err != nil {
-		return err
+		return wrapError(AddOperation, ptype, rule, err)
 	}
-	_, err = a.collection.CreateDocument(context.Background(), line)
-	return err
+	if a.metadataOn {
+		line[metadataField] = a.metadata(ctx)
+	}
+	for name, value := range extra {
+		line[name] = value
+	}
+	err = a.transaction(ctx, func(ctx context.Context) error {
+		added, err := a.addLine(ctx, sec, ptype, rule, line)
+		if err != nil || !added {
+			return err
+		}
+		return a.auditChange(ctx, AddOperation, nil, []PolicyRule{{Sec: sec, PType: ptype, Rule: rule}})
+	})
+	return wrapError(AddOperation, ptype, rule, err)
 }
 
-// RemovePolicy removes a policy rule from the storage.
-func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+// addLine writes document of a rule and reports whether it has been written; in overwrite mode
+// ignore document with existing key is skipped.
+func (a *adapter) addLine(ctx context.Context, sec string, ptype string, rule []string, line map[string]interface{}) (bool, error) {
+	if a.validity {
+		if err := a.retireExpired(ctx); err != nil {
+			return false, err
+		}
+	}
+	if a.tombstones() {
+		n, err := a.insertTracked(ctx, []interface{}{line})
+		return n > 0, err
+	}
+	if a.isGraphSection(sec) {
+		n, err := a.writeEdges(a.writeContext(ctx), []policyLine{{sec: sec, ptype: ptype, rule: rule}}, []interface{}{line})
+		return n > 0, err
+	}
+	if a.overwriteMode != arango.OverwriteModeIgnore {
+		_, err := a.collection.CreateDocument(a.writeContext(ctx), line)
+		return err == nil, err
+	}
+	// new version of document is returned only if it has been created
+	var created map[string]interface{}
+	_, err := a.collection.CreateDocument(arango.WithReturnNew(a.writeContext(ctx), &created), line)
+	return created != nil, err
+}
+
+// appendSectionFilter constrains removal to given section. Documents stored without section
+// attribute (written by older versions or other tools) are matched by ptype only.
+func (a *adapter) appendSectionFilter(comp []string, bindings map[string]interface{}, sec string) []string {
+	if a.sectionField == "" {
+		return comp
+	}
+	bindings["sec"] = sec
+	return append(comp, fmt.Sprintf(`d.%s IN [@sec, null]`, a.sectionField))
+}
+
+// ruleFilter returns AQL condition matching document d storing exactly given rule, together with
+// its bindings.
+func (a *adapter) ruleFilter(sec string, ptype string, rule []string) (string, map[string]interface{}) {
+	return a.ruleFilterOn(a.mapping[0], sec, ptype, rule)
+}
+
+// ruleFilterOn works as ruleFilter matching ptype against given attribute (e.g. of tombstone).
+func (a *adapter) ruleFilterOn(ptypeField string, sec string, ptype string, rule []string) (string, map[string]interface{}) {
 	comp := make([]string, 0)
 	bindings := make(map[string]interface{})
-	comp = append(comp, fmt.Sprintf(`d.%s == @ptype`, a.mapping[0]))
+	comp = append(comp, fmt.Sprintf(`d.%s == @ptype`, ptypeField))
 	bindings["ptype"] = ptype
-	for i, fieldValue := range rule {
-		if fieldValue != "" {
-			comp = append(comp, fmt.Sprintf(`d.%s == @%s`, a.mapping[i+1], a.mapping[i+1]))
-			bindings[a.mapping[i+1]] = fieldValue
+	comp = a.appendSectionFilter(comp, bindings, sec)
+	for i, name := range a.mapping[1:] {
+		if i < len(rule) {
+			comp = append(comp, fmt.Sprintf(`d.%s == @v%d`, name, i))
+			bindings[fmt.Sprintf("v%d", i)] = rule[i]
+		} else {
+			comp = append(comp, fmt.Sprintf(`d.%s IN [null, ""]`, name))
+		}
+	}
+	if a.arityField != "" {
+		comp = append(comp, fmt.Sprintf(`d.%s IN [@arity, null]`, a.arityField))
+		bindings["arity"] = len(rule)
+	}
+	return strings.Join(comp, " && "), bindings
+}
+
+func (a *adapter) removePolicy(sec string, ptype string, rule []string) (int, error) {
+	var n int
+	err := a.transaction(context.Background(), func(ctx context.Context) error {
+		var err error
+		n, err = a.removeRule(ctx, sec, ptype, rule)
+		if err != nil || n == 0 {
+			return err
 		}
+		return a.auditChange(ctx, RemoveOperation, []PolicyRule{{Sec: sec, PType: ptype, Rule: rule}}, nil)
+	})
+	return n, err
+}
+
+func (a *adapter) removeRule(ctx context.Context, sec string, ptype string, rule []string) (int, error) {
+	if 1+len(rule) > len(a.mapping) {
+		return 0, ErrTooManyArguments
+	}
+	if err := a.ensureReady(); err != nil {
+		return 0, err
 	}
-	query := fmt.Sprintf(a.remove, strings.Join(comp, " && "))
-	cursor, err := a.database.Query(context.Background(), query, bindings)
+	filter, bindings := a.ruleFilter(sec, ptype, rule)
+	template := a.remove
+	if a.isGraphSection(sec) {
+		template = a.graphRemove
+	}
+	query := fmt.Sprintf(template, filter)
+	cursor, err := a.database.Query(ctx, query, bindings)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	cursor.Close()
-	return nil
+	defer cursor.Close()
+	return int(cursor.Statistics().WritesExecuted()), nil
 }
 
-// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
-func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
-	if fieldIndex+len(fieldValues) > len(a.mapping) {
-		return ErrTooManyFields
+// RemovePolicy removes a policy rule from the storage. Only document storing exactly the same rule
+// is removed: all values (empty ones included), rule length and section must match. Removing rule
+// that is not stored is not an error (it may have been removed by other instance already and
+// enforcer must still drop it from model); use RemovePolicyCount to learn if anything was removed.
+func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	_, err := a.removePolicy(sec, ptype, rule)
+	return wrapError(RemoveOperation, ptype, rule, err)
+}
+
+// RemovePolicyCount removes a policy rule from the storage and returns number of removed documents.
+func (a *adapter) RemovePolicyCount(sec string, ptype string, rule []string) (int, error) {
+	n, err := a.removePolicy(sec, ptype, rule)
+	return n, wrapError(RemoveOperation, ptype, rule, err)
+}
+
+func (a *adapter) removeFilteredPolicy(returnOld bool, sec string, ptype string, fieldIndex int, fieldValues ...string) (int, [][]string, error) {
+	var n int
+	var rules [][]string
+	err := a.transaction(context.Background(), func(ctx context.Context) error {
+		var err error
+		// removed rules are needed by audit entry
+		n, rules, err = a.removeMatching(ctx, returnOld || a.auditName != "", sec, ptype, fieldIndex, fieldValues...)
+		if err != nil || n == 0 {
+			return err
+		}
+		before := make([]PolicyRule, 0, len(rules))
+		for _, rule := range rules {
+			before = append(before, PolicyRule{Sec: sec, PType: ptype, Rule: rule})
+		}
+		return a.auditChange(ctx, RemoveOperation, before, nil)
+	})
+	return n, rules, err
+}
+
+func (a *adapter) removeMatching(ctx context.Context, returnOld bool, sec string, ptype string, fieldIndex int, fieldValues ...string) (int, [][]string, error) {
+	if fieldIndex < 0 || fieldIndex+len(fieldValues) > len(a.mapping)-1 {
+		return 0, nil, ErrTooManyFields
+	}
+	if err := a.ensureReady(); err != nil {
+		return 0, nil, err
 	}
 	comp := make([]string, 0)
 	bindings := make(map[string]interface{})
 	comp = append(comp, fmt.Sprintf(`d.%s == @ptype`, a.mapping[0]))
 	bindings["ptype"] = ptype
+	comp = a.appendSectionFilter(comp, bindings, sec)
 	for i, fieldValue := range fieldValues {
 		if fieldValue != "" {
 			comp = append(comp, fmt.Sprintf(`d.%s == @%s`, a.mapping[i+fieldIndex+1], a.mapping[i+fieldIndex+1]))
 			bindings[a.mapping[i+fieldIndex+1]] = fieldValue
 		}
 	}
-	query := fmt.Sprintf(a.removeFiltered, strings.Join(comp, " && "))
-	_, err := a.database.Query(context.Background(), query, bindings)
-	return err
+	template := a.removeFiltered
+	if a.isGraphSection(sec) {
+		template = a.graphRemove
+	}
+	query := fmt.Sprintf(template, strings.Join(comp, " && "))
+	if returnOld {
+		query += " RETURN " + a.projection("OLD")
+	}
+	cursor, err := a.database.Query(ctx, query, bindings)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cursor.Close()
+
+	var rules [][]string
+	var row []interface{}
+	for returnOld {
+		_, err := cursor.ReadDocument(ctx, &row)
+		if arango.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return 0, nil, err
+		}
+		line, err := a.decodePolicyLine(row)
+		if err != nil {
+			return 0, nil, err
+		}
+		rules = append(rules, line.rule)
+	}
+	return int(cursor.Statistics().WritesExecuted()), rules, nil
+}
+
+// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
+func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	_, _, err := a.removeFilteredPolicy(false, sec, ptype, fieldIndex, fieldValues...)
+	return wrapError(RemoveOperation, ptype, fieldValues, err)
+}
+
+// RemoveFilteredPolicyCount removes policy rules that match the filter from the storage and returns
+// number of removed documents.
+func (a *adapter) RemoveFilteredPolicyCount(sec string, ptype string, fieldIndex int, fieldValues ...string) (int, error) {
+	n, _, err := a.removeFilteredPolicy(false, sec, ptype, fieldIndex, fieldValues...)
+	return n, wrapError(RemoveOperation, ptype, fieldValues, err)
+}
+
+// RemoveFilteredPolicyRules removes policy rules that match the filter from the storage and returns
+// them. If any of removed documents does not form valid rule ErrInvalidPolicyDocument is returned.
+// Removal is reverted in such case only if it runs in transaction, i.e. with OpAudit or
+// OpVersioning; otherwise rules stay removed.
+func (a *adapter) RemoveFilteredPolicyRules(sec string, ptype string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	_, rules, err := a.removeFilteredPolicy(true, sec, ptype, fieldIndex, fieldValues...)
+	return rules, wrapError(RemoveOperation, ptype, fieldValues, err)
 }
@@ -16,15 +16,20 @@ package arangodbadapter
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/arangodb/go-driver"
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/persist"
+	"github.com/casbin/casbin/v2/util"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -321,6 +326,2123 @@ func TestArangodbSave(t *testing.T) {
 	})
 }
 
+func TestArangodbSchema(t *testing.T) {
+	Convey("Given arangodb adapter with schema validation enabled", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSchema"),
+			OpSchemaValidation(driver.CollectionSchemaLevelStrict),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Valid policy documents should be accepted", func() {
+			err = loadFixtures(ad, []string{"p,ADMIN,read,book"})
+			So(err, ShouldBeNil)
+
+			violations, err := ad.VerifySchema()
+			So(err, ShouldBeNil)
+			So(violations, ShouldBeEmpty)
+		})
+
+		Convey("Documents with unknown attributes should be rejected", func() {
+			a := ad.(*adapter)
+			_, err = a.collection.CreateDocument(context.Background(), map[string]interface{}{
+				"Type": "p", "Arg0": "ADMIN", "Extra": "value",
+			})
+			So(driver.IsArangoErrorWithErrorNum(err, 1620), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given arangodb adapter with schema validation, change tracking and tombstone retention", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSchemaTracking"),
+			OpSchemaValidation(driver.CollectionSchemaLevelStrict),
+			OpChangeTracking(true),
+			OpTombstoneRetention(time.Hour),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Tombstones with purge time should be accepted", func() {
+			So(ad.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+			So(ad.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+			So(ad.RemovePolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+			So(ad.RemoveFilteredPolicy("p", "p", 0, "USER"), ShouldBeNil)
+
+			violations, err := ad.VerifySchema()
+			So(err, ShouldBeNil)
+			So(violations, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given arangodb adapter without schema validation", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSchemaVerify"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When malformed documents are inserted", func() {
+			a := ad.(*adapter)
+			meta, err := a.collection.CreateDocument(context.Background(), map[string]interface{}{
+				"Type": "p", "Arg0": 42,
+			})
+			So(err, ShouldBeNil)
+			err = loadFixtures(ad, []string{"p,ADMIN,read,book"})
+			So(err, ShouldBeNil)
+
+			Convey("VerifySchema should report them", func() {
+				violations, err := ad.VerifySchema()
+				So(err, ShouldBeNil)
+				So(violations, ShouldHaveLength, 1)
+				So(violations[0].Key, ShouldEqual, meta.Key)
+			})
+		})
+	})
+}
+
+func TestArangodbTolerantLoad(t *testing.T) {
+	Convey("Given arangodb adapter in tolerant load mode", t, func() {
+		skipped := []InvalidDocument{}
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbTolerantLoad"),
+			OpTolerantLoad(func(doc InvalidDocument) {
+				skipped = append(skipped, doc)
+			}),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When database contains valid and invalid documents", func() {
+			a := ad.(*adapter)
+			badType, err := a.collection.CreateDocument(context.Background(), map[string]interface{}{
+				"Type": "p", "Arg0": 42, "Arg1": "read", "Arg2": "book",
+			})
+			So(err, ShouldBeNil)
+			noType, err := a.collection.CreateDocument(context.Background(), map[string]interface{}{
+				"Arg0": "USER", "Arg1": "read", "Arg2": "book",
+			})
+			So(err, ShouldBeNil)
+			err = loadFixtures(ad, []string{"p,ADMIN,read,book"})
+			So(err, ShouldBeNil)
+
+			enforcer, err := newEnforcer()
+			So(err, ShouldBeNil)
+			enforcer.SetAdapter(ad)
+			err = enforcer.LoadPolicy()
+			So(err, ShouldBeNil)
+
+			Convey("Valid rules should be loaded and invalid reported", func() {
+				result, err := enforcer.Enforce("ADMIN", "read", "book")
+				So(err, ShouldBeNil)
+				So(result, ShouldBeTrue)
+
+				So(skipped, ShouldHaveLength, 2)
+				keys := []string{skipped[0].Key, skipped[1].Key}
+				So(keys, ShouldContain, badType.Key)
+				So(keys, ShouldContain, noType.Key)
+				So(errors.Is(skipped[0].Err, ErrInvalidPolicyDocument), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestArangodbEmptyValues(t *testing.T) {
+	Convey("Given arangodb adapter", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbEmptyValues"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When rules with empty values are saved", func() {
+			enforcer, err := newEnforcer()
+			So(err, ShouldBeNil)
+			enforcer.SetAdapter(ad)
+
+			_, err = enforcer.AddPolicy("alice", "", "read")
+			So(err, ShouldBeNil)
+			_, err = enforcer.AddPolicy("bob", "data1", "")
+			So(err, ShouldBeNil)
+			err = enforcer.SavePolicy()
+			So(err, ShouldBeNil)
+
+			Convey("They should be loaded back unchanged", func() {
+				loaded, err := newEnforcer()
+				So(err, ShouldBeNil)
+				loaded.SetAdapter(ad)
+				err = loaded.LoadPolicy()
+				So(err, ShouldBeNil)
+
+				So(loaded.GetPolicy(), ShouldContain, []string{"alice", "", "read"})
+				So(loaded.GetPolicy(), ShouldContain, []string{"bob", "data1", ""})
+			})
+		})
+
+		Convey("When legacy documents without arity are stored", func() {
+			err = loadFixtures(ad, []string{"p,alice,,read", "g,adam,ADMIN"})
+			So(err, ShouldBeNil)
+
+			Convey("Empty values in the middle should be preserved", func() {
+				enforcer, err := newEnforcer()
+				So(err, ShouldBeNil)
+				enforcer.SetAdapter(ad)
+				err = enforcer.LoadPolicy()
+				So(err, ShouldBeNil)
+
+				So(enforcer.GetPolicy(), ShouldResemble, [][]string{{"alice", "", "read"}})
+				So(enforcer.GetGroupingPolicy(), ShouldResemble, [][]string{{"adam", "ADMIN"}})
+			})
+		})
+	})
+}
+
+func TestArangodbSection(t *testing.T) {
+	Convey("Given arangodb adapter", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSection"),
+		)
+		So(err, ShouldBeNil)
+
+		enforcer, err := newEnforcer()
+		So(err, ShouldBeNil)
+		enforcer.SetAdapter(ad)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When policies are saved", func() {
+			_, err = enforcer.AddPolicy("ADMIN", "write", "book")
+			So(err, ShouldBeNil)
+			_, err = enforcer.AddGroupingPolicy("adam", "ADMIN")
+			So(err, ShouldBeNil)
+			err = enforcer.SavePolicy()
+			So(err, ShouldBeNil)
+
+			Convey("Each document should have its section persisted", func() {
+				sections, err := countBySection(ad)
+				So(err, ShouldBeNil)
+				So(sections, ShouldResemble, map[string]int{"p": 1, "g": 1})
+			})
+
+			Convey("Removal should be constrained to section", func() {
+				n, err := ad.RemovePolicyCount("g", "p", []string{"ADMIN", "write", "book"})
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+
+				sections, err := countBySection(ad)
+				So(err, ShouldBeNil)
+				So(sections, ShouldResemble, map[string]int{"p": 1, "g": 1})
+			})
+		})
+	})
+}
+
+func TestArangodbRemoveExact(t *testing.T) {
+	Convey("Given arangodb adapter", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbRemoveExact"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When rules sharing prefix are stored", func() {
+			So(ad.AddPolicy("p", "p", []string{"alice", "data1", "read"}), ShouldBeNil)
+			So(ad.AddPolicy("p", "p", []string{"alice", "data1"}), ShouldBeNil)
+			So(ad.AddPolicy("p", "p", []string{"alice", "", "read"}), ShouldBeNil)
+
+			Convey("Removing shorter rule should leave longer one", func() {
+				err = ad.RemovePolicy("p", "p", []string{"alice", "data1"})
+				So(err, ShouldBeNil)
+
+				content, err := getAllDbContent(ad)
+				So(err, ShouldBeNil)
+				So(content, ShouldResemble, map[string]bool{
+					"p,alice,data1,read": true,
+					"p,alice,read":       true,
+				})
+			})
+
+			Convey("Removing rule with empty value should match only that rule", func() {
+				err = ad.RemovePolicy("p", "p", []string{"alice", "", "read"})
+				So(err, ShouldBeNil)
+
+				content, err := getAllDbContent(ad)
+				So(err, ShouldBeNil)
+				So(content, ShouldResemble, map[string]bool{
+					"p,alice,data1,read": true,
+					"p,alice,data1":      true,
+				})
+			})
+
+			Convey("Removing missing rule should not fail", func() {
+				err = ad.RemovePolicy("p", "p", []string{"alice", "data2", "read"})
+				So(err, ShouldBeNil)
+				n, err := ad.RemovePolicyCount("p", "p", []string{"alice", "data2", "read"})
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestArangodbRemoveCount(t *testing.T) {
+	Convey("Given arangodb adapter with stored rules", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbRemoveCount"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		So(ad.AddPolicy("p", "p", []string{"alice", "data1", "read"}), ShouldBeNil)
+		So(ad.AddPolicy("p", "p", []string{"bob", "data1", "write"}), ShouldBeNil)
+		So(ad.AddPolicy("p", "p", []string{"bob", "data2", "write"}), ShouldBeNil)
+
+		Convey("RemovePolicyCount should report number of removed rules", func() {
+			n, err := ad.RemovePolicyCount("p", "p", []string{"alice", "data1", "read"})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+
+			n, err = ad.RemovePolicyCount("p", "p", []string{"alice", "data1", "read"})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("RemoveFilteredPolicyCount should report number of removed rules", func() {
+			n, err := ad.RemoveFilteredPolicyCount("p", "p", 1, "data1")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+		})
+
+		Convey("RemoveFilteredPolicyRules should return removed rules", func() {
+			rules, err := ad.RemoveFilteredPolicyRules("p", "p", 0, "bob")
+			So(err, ShouldBeNil)
+			So(rules, ShouldHaveLength, 2)
+			So(rules, ShouldContain, []string{"bob", "data1", "write"})
+			So(rules, ShouldContain, []string{"bob", "data2", "write"})
+		})
+
+		Convey("Filter exceeding field mapping should be rejected", func() {
+			_, err := ad.RemoveFilteredPolicyCount("p", "p", 2, "read", "extra")
+			So(errors.Is(err, ErrTooManyFields), ShouldBeTrue)
+		})
+	})
+}
+
+func TestArangodbDeterministicKeys(t *testing.T) {
+	Convey("Given arangodb adapter with deterministic keys", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbDeterministicKeys"),
+			OpDeterministicKeys(true),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Adding the same partial rule twice should fail with ErrPolicyExists", func() {
+			So(ad.AddPolicy("p", "p", []string{"alice", "data1"}), ShouldBeNil)
+			err = ad.AddPolicy("p", "p", []string{"alice", "data1"})
+			So(errors.Is(err, ErrPolicyExists), ShouldBeTrue)
+
+			content, err := getAllDbContent(ad)
+			So(err, ShouldBeNil)
+			So(content, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Given arangodb adapter with deterministic keys ignoring existing rules", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbDeterministicKeys"),
+			OpDeterministicKeys(true),
+			OpOverwriteMode(driver.OverwriteModeIgnore),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Adding the same rule twice should succeed", func() {
+			So(ad.AddPolicy("p", "p", []string{"alice", "data1", "read"}), ShouldBeNil)
+			So(ad.AddPolicy("p", "p", []string{"alice", "data1", "read"}), ShouldBeNil)
+
+			content, err := getAllDbContent(ad)
+			So(err, ShouldBeNil)
+			So(content, ShouldResemble, map[string]bool{"p,alice,data1,read": true})
+		})
+	})
+}
+
+func TestArangodbErrors(t *testing.T) {
+	Convey("Given arangodb adapter with schema validation enabled", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbErrors"),
+			OpSchemaValidation(driver.CollectionSchemaLevelStrict),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Removing missing rule should succeed", func() {
+			err = ad.RemovePolicy("p", "p", []string{"alice", "data1", "read"})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Adding existing rule should describe failed operation", func() {
+			So(ad.AddPolicy("p", "p", []string{"alice", "data1", "read"}), ShouldBeNil)
+			err = ad.AddPolicy("p", "p", []string{"alice", "data1", "read"})
+			var adapterErr *Error
+			So(errors.As(err, &adapterErr), ShouldBeTrue)
+			So(adapterErr.Op, ShouldEqual, AddOperation)
+			So(adapterErr.PType, ShouldEqual, "p")
+			So(adapterErr.Rule, ShouldResemble, []string{"alice", "data1", "read"})
+			So(errors.Is(err, ErrPolicyExists), ShouldBeTrue)
+		})
+
+		Convey("Rule rejected by schema should be reported as invalid document", func() {
+			err = ad.AddPolicy("p", "", []string{"alice"})
+			var adapterErr *Error
+			So(errors.As(err, &adapterErr), ShouldBeTrue)
+			So(adapterErr.ErrorNum, ShouldEqual, 1620)
+			So(errors.Is(err, ErrInvalidPolicyDocument), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given errors reported by database", t, func() {
+		unauthorized := wrapError(LoadOperation, "", nil, driver.ArangoError{HasError: true, Code: 401, ErrorNum: 11})
+		conflict := wrapError(AddOperation, "p", []string{"alice"}, driver.ArangoError{HasError: true, Code: 409, ErrorNum: 1210})
+
+		Convey("They should be classified by errors.Is", func() {
+			So(errors.Is(unauthorized, ErrUnauthorized), ShouldBeTrue)
+			So(errors.Is(unauthorized, ErrPolicyExists), ShouldBeFalse)
+			So(errors.Is(conflict, ErrPolicyExists), ShouldBeTrue)
+			So(conflict.(*Error).ErrorNum, ShouldEqual, 1210)
+		})
+	})
+}
+
+// decodePolicyDocument is a decoder of policy documents read into map, as used before rows were
+// introduced; kept as a baseline for benchmarks.
+func decodePolicyDocument(a *adapter, doc map[string]interface{}) (policyLine, error) {
+	ptype, ok := doc[a.mapping[0]].(string)
+	if !ok || ptype == "" {
+		return policyLine{}, fmt.Errorf("%w: missing %s", ErrInvalidPolicyDocument, a.mapping[0])
+	}
+
+	sec := ptype[:1]
+	if a.sectionField != "" && doc[a.sectionField] != nil {
+		sec, ok = doc[a.sectionField].(string)
+		if !ok || sec == "" {
+			return policyLine{}, fmt.Errorf("%w: invalid %s", ErrInvalidPolicyDocument, a.sectionField)
+		}
+	}
+
+	values := make([]string, 0, len(a.mapping)-1)
+	last := -1
+	for i, name := range a.mapping[1:] {
+		switch value := doc[name].(type) {
+		case nil:
+			values = append(values, "")
+		case string:
+			values = append(values, value)
+			if value != "" {
+				last = i
+			}
+		default:
+			return policyLine{}, fmt.Errorf("%w: field %s is not a string", ErrInvalidPolicyDocument, name)
+		}
+	}
+
+	arity := last + 1
+	if a.arityField != "" && doc[a.arityField] != nil {
+		n, ok := doc[a.arityField].(float64)
+		if !ok || n != float64(int(n)) || n < 1 || int(n) > len(values) {
+			return policyLine{}, fmt.Errorf("%w: invalid %s", ErrInvalidPolicyDocument, a.arityField)
+		}
+		arity = int(n)
+	}
+	if arity == 0 {
+		return policyLine{}, fmt.Errorf("%w: no rule values", ErrInvalidPolicyDocument)
+	}
+	return policyLine{sec: sec, ptype: ptype, rule: values[:arity]}, nil
+}
+
+// loadPolicyDocuments loads policy reading whole documents into maps, as LoadPolicy did before
+// rows were introduced; kept as a baseline for benchmarks.
+func loadPolicyDocuments(a *adapter, m model.Model) error {
+	query := fmt.Sprintf("FOR d IN %s RETURN d", a.collectionName)
+	cursor, err := a.database.Query(context.Background(), query, nil)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	for {
+		doc := make(map[string]interface{})
+		_, err := cursor.ReadDocument(context.Background(), &doc)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		line, err := decodePolicyDocument(a, doc)
+		if err == nil {
+			err = a.loadPolicyLine(line, m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkDecodePolicyLine(b *testing.B) {
+	a := &adapter{mapping: defaultMapping, arityField: "Arity", sectionField: "Section"}
+	object := []byte(`{"_key":"123","PType":"p","V0":"alice","V1":"data1","V2":"read","V3":null,"V4":null,"V5":null,"Arity":3,"Section":"p"}`)
+	array := []byte(`["123","p","alice","data1","read",null,null,null,3,"p"]`)
+
+	b.Run("Map per document", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			doc := make(map[string]interface{})
+			if err := json.Unmarshal(object, &doc); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := decodePolicyDocument(a, doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Reused row", func(b *testing.B) {
+		b.ReportAllocs()
+		var row []interface{}
+		for i := 0; i < b.N; i++ {
+			if err := json.Unmarshal(array, &row); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := a.decodePolicyLine(row); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkArangodbLoad(b *testing.B) {
+	const rules = 10000
+
+	variants := []struct {
+		name string
+		in   []adapterOption
+	}{
+		{"Map per document", nil},
+		{"Defaults", nil},
+		{"Batch Size", []adapterOption{OpBatchSize(5000)}},
+		{"Stream Cursor", []adapterOption{OpBatchSize(5000), OpStreamCursor(true), OpCursorTTL(time.Minute)}},
+		{"Parallel Cursors", []adapterOption{OpBatchSize(5000), OpParallelLoad(4)}},
+	}
+
+	ad, err := NewAdapter(OpCollectionName("casbin_BenchmarkArangodbLoad"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	m, err := model.NewModelFromString(rbacModel)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < rules; i++ {
+		m.AddPolicy("p", "p", []string{fmt.Sprintf("user%d", i), "data", "read"})
+	}
+	if err := ad.SavePolicy(m); err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = truncateCollection(ad) }()
+
+	for _, v := range variants {
+		ad, err := NewAdapter(append([]adapterOption{OpCollectionName("casbin_BenchmarkArangodbLoad")}, v.in...)...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		load := ad.LoadPolicy
+		if v.name == "Map per document" {
+			load = func(m model.Model) error {
+				return loadPolicyDocuments(ad.(*adapter), m)
+			}
+		}
+		b.Run(v.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m, _ := model.NewModelFromString(rbacModel)
+				if err := load(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestArangodbParallelLoad(t *testing.T) {
+	Convey("Given arangodb adapter loading policy with parallel cursors", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbParallelLoad"),
+			OpParallelLoad(4),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When database contains many rules", func() {
+			fixtures := []string{}
+			for i := 0; i < 50; i++ {
+				fixtures = append(fixtures, fmt.Sprintf("p,user%02d,data,read", i))
+			}
+			fixtures = append(fixtures, "g,user00,ADMIN")
+			err = loadFixtures(ad, fixtures)
+			So(err, ShouldBeNil)
+
+			Convey("All of them should be loaded in order of keys", func() {
+				enforcer, err := newEnforcer()
+				So(err, ShouldBeNil)
+				enforcer.SetAdapter(ad)
+				err = enforcer.LoadPolicy()
+				So(err, ShouldBeNil)
+
+				policy := enforcer.GetPolicy()
+				So(policy, ShouldHaveLength, 50)
+				for i, rule := range policy {
+					So(rule[0], ShouldEqual, fmt.Sprintf("user%02d", i))
+				}
+				So(enforcer.GetGroupingPolicy(), ShouldResemble, [][]string{{"user00", "ADMIN"}})
+			})
+		})
+
+		Convey("When database is empty nothing should be loaded", func() {
+			enforcer, err := newEnforcer()
+			So(err, ShouldBeNil)
+			enforcer.SetAdapter(ad)
+			err = enforcer.LoadPolicy()
+			So(err, ShouldBeNil)
+			So(enforcer.GetPolicy(), ShouldBeEmpty)
+		})
+
+		Convey("When ranges hold more rules than are buffered", func() {
+			fixtures := []string{}
+			for i := 0; i < 8*partBuffer; i++ {
+				fixtures = append(fixtures, fmt.Sprintf("p,user%05d,data,read", i))
+			}
+			err = loadFixtures(ad, fixtures)
+			So(err, ShouldBeNil)
+
+			Convey("All of them should be loaded", func() {
+				m, err := model.NewModelFromString(rbacModel)
+				So(err, ShouldBeNil)
+				So(ad.LoadPolicy(m), ShouldBeNil)
+				So(m.GetPolicy("p", "p"), ShouldHaveLength, 8*partBuffer)
+			})
+
+			Convey("Invalid document should stop loading", func() {
+				err = loadFixtures(ad, []string{"x,user,data,read"})
+				So(err, ShouldBeNil)
+				m, err := model.NewModelFromString(rbacModel)
+				So(err, ShouldBeNil)
+				So(errors.Is(ad.LoadPolicy(m), ErrInvalidPolicyDocument), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestArangodbLoadIfChanged(t *testing.T) {
+	Convey("Given arangodb adapter", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbLoadIfChanged"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		m, err := model.NewModelFromString(rbacModel)
+		So(err, ShouldBeNil)
+
+		Convey("Policy should be reported as changed before first load", func() {
+			changed, err := ad.Changed()
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+		})
+
+		Convey("When policy has been loaded", func() {
+			err = loadFixtures(ad, []string{"p,ADMIN,read,book"})
+			So(err, ShouldBeNil)
+			loaded, err := ad.LoadPolicyIfChanged(m)
+			So(err, ShouldBeNil)
+			So(loaded, ShouldBeTrue)
+
+			Convey("Loading again should be skipped", func() {
+				loaded, err := ad.LoadPolicyIfChanged(m)
+				So(err, ShouldBeNil)
+				So(loaded, ShouldBeFalse)
+				So(m["p"]["p"].Policy, ShouldHaveLength, 1)
+			})
+
+			Convey("Modification should be detected", func() {
+				So(ad.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+				changed, err := ad.Changed()
+				So(err, ShouldBeNil)
+				So(changed, ShouldBeTrue)
+			})
+
+			Convey("Rule removed in the meantime should be removed from model", func() {
+				So(ad.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+				So(ad.RemovePolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+				loaded, err := ad.LoadPolicyIfChanged(m)
+				So(err, ShouldBeNil)
+				So(loaded, ShouldBeTrue)
+				So(m["p"]["p"].Policy, ShouldResemble, [][]string{{"USER", "read", "book"}})
+				So(m.HasPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeFalse)
+			})
+
+			Convey("Model should be kept if loading fails", func() {
+				So(loadFixtures(ad, []string{"x,USER,read,book"}), ShouldBeNil)
+				_, err := ad.LoadPolicyIfChanged(m)
+				So(errors.Is(err, ErrInvalidPolicyDocument), ShouldBeTrue)
+				So(m["p"]["p"].Policy, ShouldResemble, [][]string{{"ADMIN", "read", "book"}})
+			})
+		})
+	})
+}
+
+func TestArangodbSync(t *testing.T) {
+	Convey("Given two arangodb adapters with change tracking", t, func() {
+		writer, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSync"),
+			OpChangeTracking(true),
+		)
+		So(err, ShouldBeNil)
+		reader, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSync"),
+			OpChangeTracking(true),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			err = truncateCollection(writer)
+			So(err, ShouldBeNil)
+		})
+
+		So(writer.AddPolicy("p", "p", []string{"ADMIN", "write", "book"}), ShouldBeNil)
+		So(writer.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+
+		m, err := model.NewModelFromString(rbacModel)
+		So(err, ShouldBeNil)
+		So(reader.SyncPolicy(m), ShouldBeNil)
+		So(m.GetPolicy("p", "p"), ShouldHaveLength, 2)
+
+		Convey("When rules are added and removed by other adapter", func() {
+			So(writer.RemovePolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+			So(writer.AddPolicy("g", "g", []string{"adam", "ADMIN"}), ShouldBeNil)
+
+			Convey("Sync should apply only these changes", func() {
+				So(reader.SyncPolicy(m), ShouldBeNil)
+				So(m.GetPolicy("p", "p"), ShouldResemble, [][]string{{"ADMIN", "write", "book"}})
+				So(m.GetPolicy("g", "g"), ShouldResemble, [][]string{{"adam", "ADMIN"}})
+			})
+
+			Convey("Removed rule should not be loaded", func() {
+				fresh, err := model.NewModelFromString(rbacModel)
+				So(err, ShouldBeNil)
+				So(reader.LoadPolicy(fresh), ShouldBeNil)
+				So(fresh.GetPolicy("p", "p"), ShouldResemble, [][]string{{"ADMIN", "write", "book"}})
+			})
+
+			Convey("Removed rule may be added again", func() {
+				So(writer.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+				So(reader.SyncPolicy(m), ShouldBeNil)
+				So(m.HasPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeTrue)
+			})
+		})
+
+		Convey("When whole policy is saved by other adapter", func() {
+			saved, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			saved.AddPolicy("p", "p", []string{"ADMIN", "write", "book"})
+			saved.AddPolicy("p", "p", []string{"ADMIN", "read", "book"})
+			So(writer.SavePolicy(saved), ShouldBeNil)
+
+			Convey("Sync should reflect the difference", func() {
+				So(reader.SyncPolicy(m), ShouldBeNil)
+				So(m.GetPolicy("p", "p"), ShouldHaveLength, 2)
+				So(m.HasPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeTrue)
+				So(m.HasPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given two arangodb adapters with change tracking and tombstone retention", t, func() {
+		writer, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSync"),
+			OpChangeTracking(true),
+			OpTombstoneRetention(time.Hour),
+		)
+		So(err, ShouldBeNil)
+		reader, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSync"),
+			OpChangeTracking(true),
+			OpTombstoneRetention(time.Hour),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(writer), ShouldBeNil)
+		})
+
+		So(writer.AddPolicy("p", "p", []string{"ADMIN", "write", "book"}), ShouldBeNil)
+		So(writer.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+		m, err := model.NewModelFromString(rbacModel)
+		So(err, ShouldBeNil)
+		So(reader.SyncPolicy(m), ShouldBeNil)
+		So(writer.RemovePolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+
+		Convey("Tombstone should expire after retention period", func() {
+			a := writer.(*adapter)
+			cursor, err := a.database.Query(context.Background(), fmt.Sprintf(
+				"FOR d IN %s FILTER d.DeletedAt != null RETURN DATE_DIFF(d.DeletedAt, d.ExpireAt, 'h')",
+				a.collectionName), nil)
+			So(err, ShouldBeNil)
+			defer cursor.Close()
+			var hours float64
+			_, err = cursor.ReadDocument(context.Background(), &hours)
+			So(err, ShouldBeNil)
+			So(hours, ShouldAlmostEqual, 1, 0.01)
+		})
+
+		Convey("Sync older than retention should fall back to full load", func() {
+			// tombstone purged by TTL index while reader was not synchronizing
+			a := writer.(*adapter)
+			_, err := a.database.Query(context.Background(), fmt.Sprintf(
+				"FOR d IN %s FILTER d.DeletedAt != null REMOVE d IN %s", a.collectionName, a.collectionName), nil)
+			So(err, ShouldBeNil)
+			r := reader.(*adapter)
+			r.syncedAt -= 2 * time.Hour.Milliseconds()
+
+			So(reader.SyncPolicy(m), ShouldBeNil)
+			So(m.GetPolicy("p", "p"), ShouldResemble, [][]string{{"ADMIN", "write", "book"}})
+		})
+
+		Convey("Failed fall back load should leave model intact", func() {
+			before := m.GetPolicy("p", "p")
+			So(loadFixtures(writer, []string{"x,USER,read,book"}), ShouldBeNil)
+			r := reader.(*adapter)
+			r.syncedAt -= 2 * time.Hour.Milliseconds()
+
+			So(errors.Is(reader.SyncPolicy(m), ErrInvalidPolicyDocument), ShouldBeTrue)
+			So(m.GetPolicy("p", "p"), ShouldResemble, before)
+		})
+	})
+
+	Convey("Given arangodb adapter without change tracking", t, func() {
+		ad, err := NewAdapter(OpCollectionName("casbin_TestArangodbSync"))
+		So(err, ShouldBeNil)
+
+		Convey("Sync should be refused", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(errors.Is(ad.SyncPolicy(m), ErrChangeTrackingOff), ShouldBeTrue)
+		})
+	})
+}
+
+func TestArangodbSnapshot(t *testing.T) {
+	Convey("Given arangodb adapter writing snapshots", t, func() {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSnapshot"),
+			OpSnapshot(path, nil),
+		)
+		So(err, ShouldBeNil)
+		So(ad.Degraded(), ShouldBeFalse)
+
+		Reset(func() {
+			err = truncateCollection(ad)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When policy is loaded from database", func() {
+			err = loadFixtures(ad, []string{"p,ADMIN,read,book", "g,adam,ADMIN"})
+			So(err, ShouldBeNil)
+			enforcer, err := newEnforcer()
+			So(err, ShouldBeNil)
+			enforcer.SetAdapter(ad)
+			So(enforcer.LoadPolicy(), ShouldBeNil)
+			So(ad.Degraded(), ShouldBeFalse)
+
+			Convey("Adapter unable to reach database should use its snapshot", func() {
+				offline, err := NewAdapter(
+					OpEndpoints("http://127.0.0.1:1"),
+					OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+					OpSnapshot(path, nil),
+				)
+				So(err, ShouldBeNil)
+				enforcer.SetAdapter(offline)
+				So(enforcer.LoadPolicy(), ShouldBeNil)
+				So(offline.Degraded(), ShouldBeTrue)
+
+				result, err := enforcer.Enforce("adam", "read", "book")
+				So(err, ShouldBeNil)
+				So(result, ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given arangodb adapter unable to reach database", t, func() {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		So(os.WriteFile(path, []byte(`{"rules":[{"sec":"p","ptype":"p","rule":["USER","read","book"]}]}`), 0600), ShouldBeNil)
+
+		ad, err := NewAdapter(OpEndpoints("http://127.0.0.1:1"), OpSnapshot(path, nil))
+		So(err, ShouldBeNil)
+
+		Convey("Policy should be loaded from snapshot", func() {
+			enforcer, err := newEnforcer()
+			So(err, ShouldBeNil)
+			enforcer.SetAdapter(ad)
+			So(enforcer.LoadPolicy(), ShouldBeNil)
+			So(ad.Degraded(), ShouldBeTrue)
+			So(enforcer.GetPolicy(), ShouldResemble, [][]string{{"USER", "read", "book"}})
+		})
+
+		Convey("Writes should fail as unavailable", func() {
+			err = ad.AddPolicy("p", "p", []string{"USER", "write", "book"})
+			So(errors.Is(err, ErrUnavailable), ShouldBeTrue)
+		})
+	})
+}
+
+func TestArangodbRoleManager(t *testing.T) {
+	Convey("Given role manager backed by arangodb graph", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbRoleManager"),
+		)
+		So(err, ShouldBeNil)
+		rm, err := NewRoleManager(ad,
+			RmOpVertexCollection("casbin_TestArangodbRoleManager_roles"),
+			RmOpEdgeCollection("casbin_TestArangodbRoleManager_links"),
+			RmOpMaxDepth(2),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(rm.Clear(), ShouldBeNil)
+			So(truncateCollection(ad), ShouldBeNil)
+		})
+
+		So(rm.AddLink("alice", "editor"), ShouldBeNil)
+		So(rm.AddLink("editor", "writer"), ShouldBeNil)
+		So(rm.AddLink("writer", "reader"), ShouldBeNil)
+		So(rm.AddLink("bob", "writer"), ShouldBeNil)
+
+		Convey("Links should be followed up to max depth", func() {
+			ok, err := rm.HasLink("alice", "writer")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = rm.HasLink("alice", "reader")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			ok, err = rm.HasLink("unknown user", "reader")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Direct roles and users should be returned", func() {
+			roles, err := rm.GetRoles("alice")
+			So(err, ShouldBeNil)
+			So(roles, ShouldResemble, []string{"editor"})
+			users, err := rm.GetUsers("writer")
+			So(err, ShouldBeNil)
+			So(users, ShouldHaveLength, 2)
+			So(users, ShouldContain, "editor")
+			So(users, ShouldContain, "bob")
+		})
+
+		Convey("Adding existing link should be accepted", func() {
+			So(rm.AddLink("alice", "editor"), ShouldBeNil)
+			users, err := rm.GetUsers("editor")
+			So(err, ShouldBeNil)
+			So(users, ShouldResemble, []string{"alice"})
+		})
+
+		Convey("Deleted link should not be followed", func() {
+			So(rm.DeleteLink("editor", "writer"), ShouldBeNil)
+			So(rm.DeleteLink("editor", "writer"), ShouldBeNil)
+			ok, err := rm.HasLink("alice", "writer")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Enforcer should resolve roles through graph", func() {
+			e, err := newEnforcer()
+			So(err, ShouldBeNil)
+			e.SetAdapter(ad)
+			e.SetRoleManager(rm)
+			_, err = e.AddPolicy("writer", "book", "write")
+			So(err, ShouldBeNil)
+			_, err = e.AddGroupingPolicy("carol", "writer")
+			So(err, ShouldBeNil)
+			ok, err := e.Enforce("carol", "book", "write")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = e.Enforce("alice", "book", "write")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func TestArangodbGraphStorage(t *testing.T) {
+	Convey("Given arangodb adapter storing grouping rules in graph", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbGraphStorage"),
+			OpGraphStorage("casbin_TestArangodbGraphStorage_roles", "casbin_TestArangodbGraphStorage_links"),
+			OpGraphName("casbin_TestArangodbGraphStorage"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.SavePolicy(m), ShouldBeNil)
+		})
+
+		e, err := newEnforcer()
+		So(err, ShouldBeNil)
+		e.SetAdapter(ad)
+		_, err = e.AddPolicy("ADMIN", "book", "write")
+		So(err, ShouldBeNil)
+		_, err = e.AddGroupingPolicy("alice", "ADMIN")
+		So(err, ShouldBeNil)
+
+		Convey("Grouping rules should be stored as edges", func() {
+			content, err := getAllDbContent(ad)
+			So(err, ShouldBeNil)
+			So(content, ShouldResemble, map[string]bool{"p,ADMIN,book,write": true})
+
+			a := ad.(*adapter)
+			cursor, err := a.database.Query(context.Background(), fmt.Sprintf(
+				"FOR v IN 1..1 OUTBOUND @start %s RETURN v.Name", a.graphEdges), map[string]interface{}{
+				"start": a.graphVertices + "/" + vertexKey("alice"),
+			})
+			So(err, ShouldBeNil)
+			defer cursor.Close()
+			var role string
+			_, err = cursor.ReadDocument(context.Background(), &role)
+			So(err, ShouldBeNil)
+			So(role, ShouldEqual, "ADMIN")
+		})
+
+		Convey("Policy should be loaded back from both collections", func() {
+			So(e.LoadPolicy(), ShouldBeNil)
+			So(e.GetPolicy(), ShouldResemble, [][]string{{"ADMIN", "book", "write"}})
+			So(e.GetGroupingPolicy(), ShouldResemble, [][]string{{"alice", "ADMIN"}})
+		})
+
+		Convey("Removed grouping rule should not be loaded", func() {
+			_, err = e.RemoveGroupingPolicy("alice", "ADMIN")
+			So(err, ShouldBeNil)
+			So(e.LoadPolicy(), ShouldBeNil)
+			So(e.GetGroupingPolicy(), ShouldBeEmpty)
+		})
+
+		Convey("Saved policy should replace stored edges", func() {
+			e.ClearPolicy()
+			_, err = e.AddNamedGroupingPolicy("g", "bob", "ADMIN")
+			So(err, ShouldBeNil)
+			So(e.SavePolicy(), ShouldBeNil)
+			So(e.LoadPolicy(), ShouldBeNil)
+			So(e.GetGroupingPolicy(), ShouldResemble, [][]string{{"bob", "ADMIN"}})
+		})
+
+		Convey("Role manager should read links stored by adapter", func() {
+			rm, err := NewRoleManager(ad)
+			So(err, ShouldBeNil)
+			e.SetRoleManager(rm)
+			So(e.LoadPolicy(), ShouldBeNil)
+			ok, err := e.Enforce("alice", "book", "write")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+	})
+
+	Convey("Graph storage combined with change tracking should be refused", t, func() {
+		_, err := NewAdapter(
+			OpGraphStorage("casbin_roles", "casbin_role_links"),
+			OpChangeTracking(true),
+		)
+		So(err, ShouldEqual, ErrGraphTracking)
+	})
+}
+
+func TestArangodbDomainRoleManager(t *testing.T) {
+	Convey("Given domain aware role manager backed by arangodb graph", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbDomainRoleManager"),
+		)
+		So(err, ShouldBeNil)
+		rm, err := NewRoleManager(ad,
+			RmOpVertexCollection("casbin_TestArangodbDomainRoleManager_roles"),
+			RmOpEdgeCollection("casbin_TestArangodbDomainRoleManager_links"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(rm.Clear(), ShouldBeNil)
+			So(truncateCollection(ad), ShouldBeNil)
+		})
+
+		So(rm.AddLink("alice", "admin", "domain1"), ShouldBeNil)
+		So(rm.AddLink("admin", "reader", "domain1"), ShouldBeNil)
+		So(rm.AddLink("alice", "reader", "domain2"), ShouldBeNil)
+		So(rm.AddLink("bob", "admin", "*"), ShouldBeNil)
+
+		Convey("Only links of given domain should be followed", func() {
+			ok, err := rm.HasLink("alice", "admin", "domain1")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = rm.HasLink("alice", "admin", "domain2")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			roles, err := rm.GetRoles("alice", "domain2")
+			So(err, ShouldBeNil)
+			So(roles, ShouldResemble, []string{"reader"})
+		})
+
+		Convey("Links of all domains should be followed without domain", func() {
+			roles, err := rm.GetRoles("alice")
+			So(err, ShouldBeNil)
+			So(roles, ShouldHaveLength, 2)
+		})
+
+		Convey("Domains should be listed", func() {
+			domains, err := rm.GetDomains("alice")
+			So(err, ShouldBeNil)
+			So(domains, ShouldHaveLength, 2)
+			So(domains, ShouldContain, "domain1")
+			So(domains, ShouldContain, "domain2")
+			domains, err = rm.GetAllDomains()
+			So(err, ShouldBeNil)
+			So(domains, ShouldHaveLength, 3)
+		})
+
+		Convey("Links of domains matching by function should be followed", func() {
+			ok, err := rm.HasLink("bob", "admin", "domain1")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			rm.AddDomainMatchingFunc("keyMatch", util.KeyMatch)
+			ok, err = rm.HasLink("bob", "reader", "domain1")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = rm.HasLink("bob", "reader", "domain2")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Role reached first over link of other domain should still be followed", func() {
+			// alice-[domain2]->reader is found before alice-[domain1]->admin-[domain1]->reader
+			ok, err := rm.HasLink("alice", "reader", "domain1")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			So(rm.AddLink("reader", "guest", "domain1"), ShouldBeNil)
+			ok, err = rm.HasLink("alice", "guest", "domain1")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = rm.HasLink("alice", "guest", "domain2")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Deleted link should not be followed", func() {
+			So(rm.DeleteLink("alice", "admin", "domain1"), ShouldBeNil)
+			ok, err := rm.HasLink("alice", "reader", "domain1")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestArangodbScope(t *testing.T) {
+	Convey("Given two arangodb adapters scoped to different tenants of one collection", t, func() {
+		newScoped := func(tenant string) Adapter {
+			ad, err := NewAdapter(
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpCollectionName("casbin_TestArangodbScope"),
+				OpScope(map[string]string{"Tenant": tenant}),
+				OpDeterministicKeys(true),
+			)
+			So(err, ShouldBeNil)
+			return ad
+		}
+		acme, other := newScoped("acme"), newScoped("other")
+
+		Reset(func() {
+			So(truncateCollection(acme), ShouldBeNil)
+		})
+
+		So(acme.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+		So(acme.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+		So(other.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+
+		Convey("The same rule may be stored by both tenants", func() {
+			counts, err := countBySection(acme)
+			So(err, ShouldBeNil)
+			So(counts["p"], ShouldEqual, 3)
+		})
+
+		Convey("Scope should not change with map it was given", func() {
+			scope := map[string]string{"Tenant": "third"}
+			third, err := NewAdapter(
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpCollectionName("casbin_TestArangodbScope"),
+				OpScope(scope),
+			)
+			So(err, ShouldBeNil)
+			scope["Tenant"] = "acme"
+			So(third.AddPolicy("p", "p", []string{"GUEST", "read", "book"}), ShouldBeNil)
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(third.LoadPolicy(m), ShouldBeNil)
+			So(m["p"]["p"].Policy, ShouldResemble, [][]string{{"GUEST", "read", "book"}})
+		})
+
+		Convey("Collection with unique index without scope should be refused", func() {
+			legacy, err := NewAdapter(
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpCollectionName("casbin_TestArangodbScope_legacy"),
+			)
+			So(err, ShouldBeNil)
+			So(truncateCollection(legacy), ShouldBeNil)
+			_, err = NewAdapter(
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpCollectionName("casbin_TestArangodbScope_legacy"),
+				OpScope(map[string]string{"Tenant": "acme"}),
+			)
+			So(errors.Is(err, ErrUnscopedIndex), ShouldBeTrue)
+		})
+
+		Convey("Each adapter should load only its own rules", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(other.LoadPolicy(m), ShouldBeNil)
+			So(m["p"]["p"].Policy, ShouldResemble, [][]string{{"ADMIN", "read", "book"}})
+		})
+
+		Convey("Saving policy should not affect other tenant", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(other.SavePolicy(m), ShouldBeNil)
+			So(acme.LoadPolicy(m), ShouldBeNil)
+			So(m["p"]["p"].Policy, ShouldHaveLength, 2)
+		})
+
+		Convey("Removing rules should not affect other tenant", func() {
+			n, err := other.RemoveFilteredPolicyCount("p", "p", 0, "ADMIN")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(acme.RemovePolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+			n, err = acme.RemovePolicyCount("p", "p", []string{"ADMIN", "read", "book"})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestArangodbAdapterFactory(t *testing.T) {
+	Convey("Given adapter factory with collection per tenant", t, func() {
+		f, err := NewAdapterFactory(
+			FactoryOpAdapterOptions(OpFieldMapping("Type", "Arg0", "Arg1", "Arg2")),
+			FactoryOpCollectionName("casbin_TestArangodbAdapterFactory_{tenant}"),
+			FactoryOpCacheSize(2),
+		)
+		So(err, ShouldBeNil)
+
+		Convey("Empty tenant id should be refused", func() {
+			_, err := f.Adapter("")
+			So(err, ShouldEqual, ErrInvalidTenant)
+		})
+
+		Convey("Tenant id unsafe in names and paths should be refused", func() {
+			_, err := f.Adapter("../acme")
+			So(err, ShouldEqual, ErrInvalidTenant)
+			_, err = f.Adapter("acme/other")
+			So(err, ShouldEqual, ErrInvalidTenant)
+		})
+
+		Convey("When adapters of tenants are requested", func() {
+			acme, err := f.Adapter("acme")
+			So(err, ShouldBeNil)
+			other, err := f.Adapter("other")
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				So(truncateCollection(acme), ShouldBeNil)
+				So(truncateCollection(other), ShouldBeNil)
+			})
+
+			Convey("They should be cached", func() {
+				again, err := f.Adapter("acme")
+				So(err, ShouldBeNil)
+				So(again, ShouldEqual, acme)
+			})
+
+			Convey("They should share client and use separate collections", func() {
+				So(acme.(*adapter).client, ShouldEqual, other.(*adapter).client)
+				So(acme.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+				content, err := getAllDbContent(other)
+				So(err, ShouldBeNil)
+				So(content, ShouldBeEmpty)
+			})
+
+			Convey("Least recently used one should be evicted", func() {
+				_, err := f.Adapter("acme")
+				So(err, ShouldBeNil)
+				third, err := f.Adapter("third")
+				So(err, ShouldBeNil)
+				defer truncateCollection(third)
+				So(f.Len(), ShouldEqual, 2)
+				again, err := f.Adapter("other")
+				So(err, ShouldBeNil)
+				So(again, ShouldNotEqual, other)
+			})
+
+			Convey("Evicted one should be created again", func() {
+				f.Evict("acme")
+				So(f.Len(), ShouldEqual, 1)
+				again, err := f.Adapter("acme")
+				So(err, ShouldBeNil)
+				So(again, ShouldNotEqual, acme)
+			})
+		})
+	})
+}
+
+func TestArangodbAdapterFactorySharedCollection(t *testing.T) {
+	Convey("Given adapter factory with collection name not depending on tenant", t, func() {
+		f, err := NewAdapterFactory(
+			FactoryOpAdapterOptions(OpFieldMapping("Type", "Arg0", "Arg1", "Arg2")),
+			FactoryOpCollectionName("casbin_TestArangodbAdapterFactorySharedCollection"),
+		)
+		So(err, ShouldBeNil)
+		acme, err := f.Adapter("acme")
+		So(err, ShouldBeNil)
+		other, err := f.Adapter("other")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(acme), ShouldBeNil)
+		})
+
+		Convey("Tenants should be scoped and keep their rules apart", func() {
+			So(acme.(*adapter).scope, ShouldResemble, map[string]string{TenantField: "acme"})
+			So(acme.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(other.SavePolicy(m), ShouldBeNil)
+			So(acme.LoadPolicy(m), ShouldBeNil)
+			So(m["p"]["p"].Policy, ShouldResemble, [][]string{{"ADMIN", "read", "book"}})
+		})
+	})
+
+	Convey("Given adapter factory with snapshot path not depending on tenant", t, func() {
+		_, err := NewAdapterFactory(
+			FactoryOpAdapterOptions(OpSnapshot("/tmp/casbin.json", nil)),
+		)
+
+		Convey("It should be refused", func() {
+			So(err, ShouldEqual, ErrSharedSnapshotPath)
+		})
+	})
+}
+
+func TestArangodbModelID(t *testing.T) {
+	Convey("Given arangodb adapters of two models sharing one collection", t, func() {
+		newModelAdapter := func(id string) Adapter {
+			ad, err := NewAdapter(
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpCollectionName("casbin_TestArangodbModelID"),
+				OpModelID(id),
+			)
+			So(err, ShouldBeNil)
+			return ad
+		}
+		api, data := newModelAdapter("api"), newModelAdapter("data")
+
+		Reset(func() {
+			So(truncateCollection(api), ShouldBeNil)
+		})
+
+		So(api.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+		So(data.AddPolicy("p", "p", []string{"alice", "read", "book"}), ShouldBeNil)
+
+		Convey("Each adapter should load only rules of its model", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(data.LoadPolicy(m), ShouldBeNil)
+			So(m["p"]["p"].Policy, ShouldResemble, [][]string{{"alice", "read", "book"}})
+		})
+
+		Convey("Saving policy should replace only rules of its model", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			m.AddPolicy("p", "p", []string{"USER", "read", "book"})
+			So(api.SavePolicy(m), ShouldBeNil)
+			counts, err := countBySection(api)
+			So(err, ShouldBeNil)
+			So(counts["p"], ShouldEqual, 2)
+
+			m, err = model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(data.LoadPolicy(m), ShouldBeNil)
+			So(m["p"]["p"].Policy, ShouldResemble, [][]string{{"alice", "read", "book"}})
+		})
+	})
+}
+
+func TestArangodbCollectionPerPType(t *testing.T) {
+	Convey("Given arangodb adapter with collection per ptype", t, func() {
+		prefix := "casbin_TestArangodbCollectionPerPType_"
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionPerPType(prefix),
+		)
+		So(err, ShouldBeNil)
+		r := ad.(*ptypeRouter)
+
+		Reset(func() {
+			for _, a := range r.loaded() {
+				So(truncateCollection(a), ShouldBeNil)
+			}
+		})
+
+		e, err := newEnforcer()
+		So(err, ShouldBeNil)
+		e.SetAdapter(ad)
+		_, err = e.AddPolicy("ADMIN", "book", "write")
+		So(err, ShouldBeNil)
+		_, err = e.AddGroupingPolicy("alice", "ADMIN")
+		So(err, ShouldBeNil)
+
+		Convey("Rules should be written to collection of their ptype", func() {
+			p, err := r.sub("p")
+			So(err, ShouldBeNil)
+			So(p.collectionName, ShouldEqual, prefix+"p")
+			content, err := getAllDbContent(p)
+			So(err, ShouldBeNil)
+			So(content, ShouldResemble, map[string]bool{"p,ADMIN,book,write": true})
+			g, err := r.sub("g")
+			So(err, ShouldBeNil)
+			content, err = getAllDbContent(g)
+			So(err, ShouldBeNil)
+			So(content, ShouldResemble, map[string]bool{"g,alice,ADMIN": true})
+		})
+
+		Convey("Policy should be loaded from all collections", func() {
+			So(e.LoadPolicy(), ShouldBeNil)
+			So(e.GetPolicy(), ShouldResemble, [][]string{{"ADMIN", "book", "write"}})
+			So(e.GetGroupingPolicy(), ShouldResemble, [][]string{{"alice", "ADMIN"}})
+			ok, err := e.Enforce("alice", "book", "write")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Saved policy should replace rules of every ptype", func() {
+			_, err = e.RemovePolicy("ADMIN", "book", "write")
+			So(err, ShouldBeNil)
+			_, err = e.AddNamedGroupingPolicy("g", "bob", "ADMIN")
+			So(err, ShouldBeNil)
+			So(e.SavePolicy(), ShouldBeNil)
+			So(e.LoadPolicy(), ShouldBeNil)
+			So(e.GetPolicy(), ShouldBeEmpty)
+			So(e.GetGroupingPolicy(), ShouldHaveLength, 2)
+		})
+
+		Convey("Schema verification should not touch other collections with the same prefix", func() {
+			p, err := r.sub("p")
+			So(err, ShouldBeNil)
+			other, err := p.database.CreateCollection(context.Background(), prefix+"audit", nil)
+			So(err, ShouldBeNil)
+			defer other.Remove(context.Background())
+
+			violations, err := ad.VerifySchema()
+			So(err, ShouldBeNil)
+			So(violations, ShouldBeEmpty)
+			So(r.subs, ShouldNotContainKey, "audit")
+		})
+	})
+
+	Convey("Given arangodb adapter with collection per ptype writing snapshots", t, func() {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionPerPType("casbin_TestArangodbCollectionPerPType_"),
+			OpSnapshot(path, nil),
+		)
+		So(err, ShouldBeNil)
+		r := ad.(*ptypeRouter)
+
+		Reset(func() {
+			for _, a := range r.loaded() {
+				So(truncateCollection(a), ShouldBeNil)
+			}
+		})
+
+		e, err := newEnforcer()
+		So(err, ShouldBeNil)
+		e.SetAdapter(ad)
+		_, err = e.AddPolicy("ADMIN", "book", "write")
+		So(err, ShouldBeNil)
+		_, err = e.AddGroupingPolicy("alice", "ADMIN")
+		So(err, ShouldBeNil)
+		So(e.LoadPolicy(), ShouldBeNil)
+
+		Convey("Snapshot of every ptype should hold only its own rules", func() {
+			data, err := os.ReadFile(path + ".p")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"rules":[{"sec":"p","ptype":"p","rule":["ADMIN","book","write"]}]}`)
+			data, err = os.ReadFile(path + ".g")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"rules":[{"sec":"g","ptype":"g","rule":["alice","ADMIN"]}]}`)
+		})
+	})
+}
+
+func TestArangodbMetadata(t *testing.T) {
+	Convey("Given arangodb adapter storing rule metadata", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbMetadata"),
+			OpMetadata(func() Metadata {
+				return Metadata{CreatedBy: "system"}
+			}),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+		})
+
+		ctx := ContextWithMetadata(context.Background(), Metadata{
+			CreatedBy: "alice",
+			Reason:    "ticket 42",
+			Labels:    map[string]string{"team": "security"},
+		})
+		So(ad.AddPolicyContext(ctx, "p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+
+		Convey("Metadata from context should be read back", func() {
+			md, err := ad.GetPolicyMetadata("p", "p", []string{"ADMIN", "read", "book"})
+			So(err, ShouldBeNil)
+			So(md.CreatedBy, ShouldEqual, "alice")
+			So(md.Reason, ShouldEqual, "ticket 42")
+			So(md.Labels, ShouldResemble, map[string]string{"team": "security"})
+			So(md.CreatedAt.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("Metadata of missing rule should not be found", func() {
+			_, err := ad.GetPolicyMetadata("p", "p", []string{"USER", "read", "book"})
+			So(errors.Is(err, ErrPolicyNotFound), ShouldBeTrue)
+		})
+
+		Convey("Metadata should be preserved by SavePolicy", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.LoadPolicy(m), ShouldBeNil)
+			m.AddPolicy("p", "p", []string{"USER", "read", "book"})
+			So(ad.SavePolicy(m), ShouldBeNil)
+
+			md, err := ad.GetPolicyMetadata("p", "p", []string{"ADMIN", "read", "book"})
+			So(err, ShouldBeNil)
+			So(md.CreatedBy, ShouldEqual, "alice")
+			md, err = ad.GetPolicyMetadata("p", "p", []string{"USER", "read", "book"})
+			So(err, ShouldBeNil)
+			So(md.CreatedBy, ShouldEqual, "system")
+		})
+	})
+}
+
+func TestArangodbAudit(t *testing.T) {
+	Convey("Given arangodb adapter with audit log", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbAudit"),
+			OpAudit("casbin_TestArangodbAudit_log", func() string {
+				return "system"
+			}),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+			So(ad.(*adapter).audit.Truncate(context.Background()), ShouldBeNil)
+		})
+
+		ctx := ContextWithMetadata(context.Background(), Metadata{CreatedBy: "alice"})
+		So(ad.AddPolicyContext(ctx, "p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+		So(ad.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+		So(ad.RemovePolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+
+		Convey("Changes should be recorded in order", func() {
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 3)
+			So(entries[0].Operation, ShouldEqual, AddOperation)
+			So(entries[0].Actor, ShouldEqual, "alice")
+			So(entries[0].After, ShouldResemble, []PolicyRule{{Sec: "p", PType: "p", Rule: []string{"ADMIN", "read", "book"}}})
+			So(entries[1].Actor, ShouldEqual, "system")
+			So(entries[2].Operation, ShouldEqual, RemoveOperation)
+			So(entries[2].Before, ShouldResemble, []PolicyRule{{Sec: "p", PType: "p", Rule: []string{"USER", "read", "book"}}})
+			So(entries[2].Time.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("Log should be paged by key of last entry", func() {
+			page, err := ad.AuditLog("", 2)
+			So(err, ShouldBeNil)
+			So(page, ShouldHaveLength, 2)
+			page, err = ad.AuditLog(page[1].Key, 2)
+			So(err, ShouldBeNil)
+			So(page, ShouldHaveLength, 1)
+			So(page[0].Operation, ShouldEqual, RemoveOperation)
+		})
+
+		Convey("SavePolicy should record removed and added rules", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			m.AddPolicy("p", "p", []string{"ADMIN", "read", "book"})
+			m.AddPolicy("p", "p", []string{"GUEST", "read", "book"})
+			So(ad.SavePolicy(m), ShouldBeNil)
+
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 4)
+			So(entries[3].Operation, ShouldEqual, SaveOperation)
+			So(entries[3].Before, ShouldBeEmpty)
+			So(entries[3].After, ShouldResemble, []PolicyRule{{Sec: "p", PType: "p", Rule: []string{"GUEST", "read", "book"}}})
+		})
+
+		Convey("Failed change should not be recorded", func() {
+			So(ad.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldNotBeNil)
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 3)
+		})
+
+		Convey("Entries should be chained with hashes", func() {
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			So(entries[0].PrevHash, ShouldBeEmpty)
+			So(entries[1].PrevHash, ShouldEqual, entries[0].Hash)
+			So(entries[2].PrevHash, ShouldEqual, entries[1].Hash)
+			So(ad.VerifyAuditLog(), ShouldBeNil)
+		})
+
+		Convey("Modified entry should be detected", func() {
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			_, err = ad.(*adapter).audit.UpdateDocument(context.Background(), entries[1].Key,
+				map[string]interface{}{"actor": "mallory"})
+			So(err, ShouldBeNil)
+			So(errors.Is(ad.VerifyAuditLog(), ErrAuditTampered), ShouldBeTrue)
+		})
+
+		Convey("Removed entry should be detected", func() {
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			_, err = ad.(*adapter).audit.RemoveDocument(context.Background(), entries[0].Key)
+			So(err, ShouldBeNil)
+			So(errors.Is(ad.VerifyAuditLog(), ErrAuditTampered), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given arangodb adapter with audit log ignoring existing rules", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbAudit"),
+			OpDeterministicKeys(true),
+			OpOverwriteMode(driver.OverwriteModeIgnore),
+			OpAudit("casbin_TestArangodbAudit_log", nil),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+			So(ad.(*adapter).audit.Truncate(context.Background()), ShouldBeNil)
+		})
+
+		Convey("Adding existing rule should not be recorded", func() {
+			So(ad.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+			So(ad.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Given arangodb adapter with audit log signed with key", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbAudit"),
+			OpAudit("casbin_TestArangodbAudit_log", nil),
+			OpAuditKey([]byte("secret")),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+			So(ad.(*adapter).audit.Truncate(context.Background()), ShouldBeNil)
+		})
+
+		So(ad.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+		So(ad.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+
+		Convey("Signed entries should be verified", func() {
+			So(ad.VerifyAuditLog(), ShouldBeNil)
+		})
+
+		Convey("Modified entry with recomputed hashes should be detected", func() {
+			entries, err := ad.AuditLog("", 10)
+			So(err, ShouldBeNil)
+			// forger knows the format but not the key
+			forger := &adapter{}
+			prevHash := ""
+			for _, entry := range entries {
+				entry.Actor = "mallory"
+				entry.PrevHash = prevHash
+				entry.Hash, err = forger.auditHash(entry)
+				So(err, ShouldBeNil)
+				_, err = ad.(*adapter).audit.UpdateDocument(context.Background(), entry.Key, map[string]interface{}{
+					"actor": entry.Actor, "prevHash": entry.PrevHash, "hash": entry.Hash,
+				})
+				So(err, ShouldBeNil)
+				prevHash = entry.Hash
+			}
+			So(errors.Is(ad.VerifyAuditLog(), ErrAuditTampered), ShouldBeTrue)
+
+			unkeyed, err := NewAdapter(
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpCollectionName("casbin_TestArangodbAudit"),
+				OpAudit("casbin_TestArangodbAudit_log", nil),
+			)
+			So(err, ShouldBeNil)
+			So(unkeyed.VerifyAuditLog(), ShouldBeNil)
+		})
+	})
+}
+
+func TestArangodbVersioning(t *testing.T) {
+	Convey("Given arangodb adapter with policy versioning", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbVersioning"),
+			OpVersioning("casbin_TestArangodbVersioning_versions"),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+			So(ad.(*adapter).versions.Truncate(context.Background()), ShouldBeNil)
+		})
+
+		m, err := model.NewModelFromString(rbacModel)
+		So(err, ShouldBeNil)
+		m.AddPolicy("p", "p", []string{"ADMIN", "read", "book"})
+		So(ad.SavePolicy(m), ShouldBeNil)
+		m.AddPolicy("p", "p", []string{"USER", "read", "book"})
+		m.RemovePolicy("p", "p", []string{"ADMIN", "read", "book"})
+		So(ad.SavePolicy(m), ShouldBeNil)
+
+		Convey("Every save should be recorded as version", func() {
+			versions, err := ad.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 2)
+			So(versions[0].Number, ShouldEqual, 1)
+			So(versions[1].Number, ShouldEqual, 2)
+			So(versions[1].Size, ShouldEqual, 1)
+			So(versions[1].Rules, ShouldBeNil)
+		})
+
+		Convey("Saving unchanged rules should not add version", func() {
+			So(ad.SavePolicy(m), ShouldBeNil)
+			versions, err := ad.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 2)
+		})
+
+		Convey("Versions should be compared", func() {
+			removed, added, err := ad.DiffVersions(1, 2)
+			So(err, ShouldBeNil)
+			So(removed, ShouldResemble, []PolicyRule{{Sec: "p", PType: "p", Rule: []string{"ADMIN", "read", "book"}}})
+			So(added, ShouldResemble, []PolicyRule{{Sec: "p", PType: "p", Rule: []string{"USER", "read", "book"}}})
+		})
+
+		Convey("Restore should bring back rules of version", func() {
+			So(ad.RestoreVersion(1), ShouldBeNil)
+			content, err := getAllDbContent(ad)
+			So(err, ShouldBeNil)
+			So(content, ShouldResemble, map[string]bool{"p,ADMIN,read,book": true})
+			versions, err := ad.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 3)
+		})
+
+		Convey("Rules changed since last save should be recorded before next save", func() {
+			So(ad.AddPolicy("p", "p", []string{"GUEST", "read", "book"}), ShouldBeNil)
+			So(ad.RestoreVersion(1), ShouldBeNil)
+			versions, err := ad.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 4)
+			_, added, err := ad.DiffVersions(2, 3)
+			So(err, ShouldBeNil)
+			So(added, ShouldResemble, []PolicyRule{{Sec: "p", PType: "p", Rule: []string{"GUEST", "read", "book"}}})
+		})
+
+		Convey("Missing version should not be restored", func() {
+			err := ad.RestoreVersion(42)
+			So(errors.Is(err, ErrVersionNotFound), ShouldBeTrue)
+		})
+	})
+}
+
+func TestArangodbSoftDelete(t *testing.T) {
+	Convey("Given arangodb adapter with soft delete", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSoftDelete"),
+			OpSoftDelete(),
+			OpTombstoneRetention(time.Hour),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+		})
+
+		So(ad.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+		So(ad.AddPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+		So(ad.RemovePolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+
+		Convey("Removed rule should be kept but not loaded", func() {
+			n, err := ad.(*adapter).collection.Count(context.Background())
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.LoadPolicy(m), ShouldBeNil)
+			So(m.GetPolicy("p", "p"), ShouldResemble, [][]string{{"ADMIN", "read", "book"}})
+		})
+
+		Convey("Removed rule should be undeleted", func() {
+			So(ad.UndeletePolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeNil)
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.LoadPolicy(m), ShouldBeNil)
+			So(m.HasPolicy("p", "p", []string{"USER", "read", "book"}), ShouldBeTrue)
+
+			err = ad.UndeletePolicy("p", "p", []string{"USER", "read", "book"})
+			So(errors.Is(err, ErrPolicyNotFound), ShouldBeTrue)
+		})
+
+		Convey("Rule removed before retention period should not be undeleted", func() {
+			a := ad.(*adapter)
+			_, err := a.database.Query(context.Background(), fmt.Sprintf(
+				"FOR d IN %s FILTER d.DeletedAt != null UPDATE d WITH {DeletedAt: DATE_ISO8601(DATE_NOW() - 7200000)} IN %s",
+				a.collectionName, a.collectionName), nil)
+			So(err, ShouldBeNil)
+			err = ad.UndeletePolicy("p", "p", []string{"USER", "read", "book"})
+			So(errors.Is(err, ErrPolicyNotFound), ShouldBeTrue)
+		})
+
+		Convey("Tombstone should expire after retention period", func() {
+			a := ad.(*adapter)
+			cursor, err := a.database.Query(context.Background(), fmt.Sprintf(
+				"FOR d IN %s FILTER d.DeletedAt != null RETURN DATE_DIFF(d.DeletedAt, d.ExpireAt, 'h')",
+				a.collectionName), nil)
+			So(err, ShouldBeNil)
+			defer cursor.Close()
+			var hours float64
+			_, err = cursor.ReadDocument(context.Background(), &hours)
+			So(err, ShouldBeNil)
+			So(hours, ShouldAlmostEqual, 1, 0.01)
+		})
+	})
+
+	Convey("Given arangodb adapter with soft delete and rule validity purged by TTL", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbSoftDelete_validity"),
+			OpSoftDelete(),
+			OpValidity(true),
+		)
+		So(err, ShouldBeNil)
+		a := ad.(*adapter)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+		})
+
+		expireAt := func() interface{} {
+			cursor, err := a.database.Query(context.Background(), fmt.Sprintf(
+				"FOR d IN %s RETURN d.ExpireAt", a.collectionName), nil)
+			So(err, ShouldBeNil)
+			defer cursor.Close()
+			var value interface{}
+			_, err = cursor.ReadDocument(context.Background(), &value)
+			So(err, ShouldBeNil)
+			return value
+		}
+
+		validUntil := time.Now().Add(time.Hour)
+		So(ad.AddPolicyWithExpiry("p", "p", []string{"ONCALL", "read", "book"}, validUntil), ShouldBeNil)
+		So(ad.RemovePolicy("p", "p", []string{"ONCALL", "read", "book"}), ShouldBeNil)
+
+		Convey("Tombstone should be kept forever", func() {
+			So(expireAt(), ShouldBeNil)
+		})
+
+		Convey("Undeleted rule should be purged when its validity ends", func() {
+			So(ad.UndeletePolicy("p", "p", []string{"ONCALL", "read", "book"}), ShouldBeNil)
+			So(expireAt(), ShouldEqual, isoTime(validUntil))
+		})
+	})
+}
+
+func TestArangodbValidity(t *testing.T) {
+	Convey("Given arangodb adapter with rule validity", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbValidity"),
+			OpValidity(true),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+		})
+
+		now := time.Now()
+		So(ad.AddPolicy("p", "p", []string{"ADMIN", "read", "book"}), ShouldBeNil)
+		So(ad.AddPolicyWithExpiry("p", "p", []string{"ONCALL", "read", "book"}, now.Add(time.Hour)), ShouldBeNil)
+		So(ad.AddPolicyWithExpiry("p", "p", []string{"CONTRACTOR", "read", "book"}, now.Add(-time.Hour)), ShouldBeNil)
+		So(ad.AddPolicyWithValidity("p", "p", []string{"NEWHIRE", "read", "book"}, now.Add(time.Hour), time.Time{}), ShouldBeNil)
+
+		Convey("Only rules valid now should be loaded", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.LoadPolicy(m), ShouldBeNil)
+			So(m.GetPolicy("p", "p"), ShouldHaveLength, 2)
+			So(m.HasPolicy("p", "p", []string{"ONCALL", "read", "book"}), ShouldBeTrue)
+			So(m.HasPolicy("p", "p", []string{"CONTRACTOR", "read", "book"}), ShouldBeFalse)
+			So(m.HasPolicy("p", "p", []string{"NEWHIRE", "read", "book"}), ShouldBeFalse)
+		})
+
+		Convey("Expired rule should be added again", func() {
+			So(ad.AddPolicyWithExpiry("p", "p", []string{"CONTRACTOR", "read", "book"}, now.Add(time.Hour)), ShouldBeNil)
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.LoadPolicy(m), ShouldBeNil)
+			So(m.HasPolicy("p", "p", []string{"CONTRACTOR", "read", "book"}), ShouldBeTrue)
+		})
+
+		Convey("SavePolicy should keep pending rules and validity of saved ones", func() {
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.LoadPolicy(m), ShouldBeNil)
+			So(ad.SavePolicy(m), ShouldBeNil)
+
+			a := ad.(*adapter)
+			cursor, err := a.database.Query(context.Background(), fmt.Sprintf(
+				"FOR d IN %s SORT d.Arg0 RETURN [d.Arg0, d.ValidUntil != null, d.ExpireAt != null]", a.collectionName), nil)
+			So(err, ShouldBeNil)
+			defer cursor.Close()
+			var rows [][]interface{}
+			for {
+				var row []interface{}
+				_, err := cursor.ReadDocument(context.Background(), &row)
+				if driver.IsNoMoreDocuments(err) {
+					break
+				}
+				So(err, ShouldBeNil)
+				rows = append(rows, row)
+			}
+			So(rows, ShouldResemble, [][]interface{}{
+				{"ADMIN", false, false},
+				{"NEWHIRE", false, false},
+				{"ONCALL", true, true},
+			})
+		})
+
+		Convey("Policy should be reported as changed once validity window has ended", func() {
+			So(ad.AddPolicyWithExpiry("p", "p", []string{"VISITOR", "read", "book"}, time.Now().Add(time.Second)), ShouldBeNil)
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.LoadPolicy(m), ShouldBeNil)
+			So(m.HasPolicy("p", "p", []string{"VISITOR", "read", "book"}), ShouldBeTrue)
+			changed, err := ad.Changed()
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeFalse)
+
+			time.Sleep(1500 * time.Millisecond)
+			changed, err = ad.Changed()
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+		})
+
+		Convey("Rule validity should require option", func() {
+			plain, err := NewAdapter(
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpCollectionName("casbin_TestArangodbValidity"),
+			)
+			So(err, ShouldBeNil)
+			err = plain.AddPolicyWithExpiry("p", "p", []string{"USER", "read", "book"}, now.Add(time.Hour))
+			So(errors.Is(err, ErrValidityOff), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given arangodb adapter with rule validity and policy versioning", t, func() {
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbValidity"),
+			OpVersioning("casbin_TestArangodbValidity_versions"),
+			OpValidity(true),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+			So(ad.(*adapter).versions.Truncate(context.Background()), ShouldBeNil)
+		})
+
+		validUntil := time.Now().Add(time.Hour)
+		So(ad.AddPolicyWithExpiry("p", "p", []string{"ONCALL", "read", "book"}, validUntil), ShouldBeNil)
+		m, err := model.NewModelFromString(rbacModel)
+		So(err, ShouldBeNil)
+		So(ad.LoadPolicy(m), ShouldBeNil)
+		So(ad.SavePolicy(m), ShouldBeNil)
+
+		Convey("Restored rule should keep its validity window", func() {
+			empty, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(ad.SavePolicy(empty), ShouldBeNil)
+			So(ad.RestoreVersion(1), ShouldBeNil)
+
+			validity, err := ad.(*adapter).storedValidity(context.Background())
+			So(err, ShouldBeNil)
+			attrs := validity[policyKey("p", "p", []string{"ONCALL", "read", "book"})]
+			So(attrs, ShouldNotBeNil)
+			So(attrs.(map[string]interface{})[validUntilField], ShouldEqual, isoTime(validUntil))
+			So(attrs.(map[string]interface{})[expireAtField], ShouldEqual, isoTime(validUntil))
+		})
+	})
+
+	Convey("Given arangodb adapter with rule validity writing snapshots", t, func() {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		ad, err := NewAdapter(
+			OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+			OpCollectionName("casbin_TestArangodbValidity"),
+			OpSnapshot(path, nil),
+			OpValidity(false),
+		)
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			So(truncateCollection(ad), ShouldBeNil)
+		})
+
+		So(ad.AddPolicyWithExpiry("p", "p", []string{"ONCALL", "read", "book"}, time.Now().Add(time.Hour)), ShouldBeNil)
+		m, err := model.NewModelFromString(rbacModel)
+		So(err, ShouldBeNil)
+		So(ad.LoadPolicy(m), ShouldBeNil)
+
+		Convey("Snapshot should not serve rule after its validity has ended", func() {
+			data, err := os.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"validUntil"`)
+
+			// the same snapshot read after the grant has ended
+			So(os.WriteFile(path, []byte(`{"rules":[{"sec":"p","ptype":"p","rule":["ONCALL","read","book"],"validUntil":"2000-01-01T00:00:00Z"}]}`), 0600), ShouldBeNil)
+
+			offline, err := NewAdapter(
+				OpEndpoints("http://127.0.0.1:1"),
+				OpFieldMapping("Type", "Arg0", "Arg1", "Arg2"),
+				OpSnapshot(path, nil),
+				OpValidity(false),
+			)
+			So(err, ShouldBeNil)
+			m, err := model.NewModelFromString(rbacModel)
+			So(err, ShouldBeNil)
+			So(offline.LoadPolicy(m), ShouldBeNil)
+			So(offline.Degraded(), ShouldBeTrue)
+			So(m.GetPolicy("p", "p"), ShouldBeEmpty)
+		})
+	})
+}
+
 // ====== end of test cases ======
 
 var rbacModel = `
@@ -423,6 +2545,9 @@ func truncateCollection(ad persist.Adapter) error {
 	if !ok {
 		return errors.New("Adapter is not arangodb.adapter type as expected")
 	}
+	if a.collection == nil {
+		return errors.New("Adapter is not connected to database")
+	}
 	err := a.collection.Truncate(context.Background())
 	return err
 }
@@ -441,3 +2566,31 @@ func loadFixtures(ad persist.Adapter, fixtures []string) error {
 	}
 	return nil
 }
+
+func countBySection(ad persist.Adapter) (map[string]int, error) {
+	a, ok := ad.(*adapter)
+	if !ok {
+		return nil, errors.New("Adapter is not arangodb.adapter type as expected")
+	}
+	query := fmt.Sprintf("FOR d IN %s COLLECT sec = d.%s WITH COUNT INTO n RETURN {sec, n}", a.collectionName, a.sectionField)
+	cursor, err := a.database.Query(context.Background(), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	result := make(map[string]int)
+	for {
+		var row struct {
+			Sec string `json:"sec"`
+			N   int    `json:"n"`
+		}
+		_, err := cursor.ReadDocument(context.Background(), &row)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		result[row.Sec] = row.N
+	}
+	return result, nil
+}
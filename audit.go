@@ -0,0 +1,320 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+var (
+	ErrAuditOff      error = errors.New("audit log is not enabled")
+	ErrAuditTampered error = errors.New("audit log has been tampered with")
+)
+
+// PolicyRule is a single policy rule as seen by casbin, together with its validity window
+// (see OpValidity).
+type PolicyRule struct {
+	Sec        string     `json:"sec"`
+	PType      string     `json:"ptype"`
+	Rule       []string   `json:"rule"`
+	ValidFrom  *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+}
+
+// AuditEntry describes single change of policy recorded in audit log.
+type AuditEntry struct {
+	// Key is a _key of entry; keys of consecutive entries are ordered
+	Key string `json:"_key,omitempty"`
+	// Time is a moment change has been made
+	Time time.Time `json:"time"`
+	// Actor identifies author of the change
+	Actor string `json:"actor,omitempty"`
+	// Operation is a kind of change: AddOperation, RemoveOperation or SaveOperation
+	Operation Operation `json:"operation"`
+	// Before lists rules removed by the change
+	Before []PolicyRule `json:"before,omitempty"`
+	// After lists rules added by the change
+	After []PolicyRule `json:"after,omitempty"`
+	// PrevHash is a Hash of preceding entry; empty for the first entry of the log
+	PrevHash string `json:"prevHash,omitempty"`
+	// Hash is SHA-256 of the entry (without its key) chaining it to the preceding one
+	Hash string `json:"hash,omitempty"`
+}
+
+// initializeAudit prepares audit log collection. Padded key generator makes keys sort in order
+// of insertion so they may be used to page through the log.
+func (a *adapter) initializeAudit() error {
+	audit, err := a.ensureCollection(a.auditName, &arango.CreateCollectionOptions{
+		KeyOptions: &arango.CollectionKeyOptions{Type: arango.KeyGeneratorType("padded")},
+	})
+	if err != nil {
+		return err
+	}
+	a.audit = audit
+	return nil
+}
+
+// actor returns author of change: one from metadata attached to context or, if there is none,
+// one supplied by provider configured with OpAudit.
+func (a *adapter) actor(ctx context.Context) string {
+	if md, ok := ctx.Value(metadataKey{}).(Metadata); ok && md.CreatedBy != "" {
+		return md.CreatedBy
+	}
+	if a.auditActor != nil {
+		return a.auditActor()
+	}
+	return ""
+}
+
+// auditChange records change in audit log; must be called within transaction of the change.
+// Audit collection is locked exclusively by the transaction so entries form single hash chain.
+func (a *adapter) auditChange(ctx context.Context, op Operation, before []PolicyRule, after []PolicyRule) error {
+	if a.auditName == "" {
+		return nil
+	}
+	prevHash, err := a.lastAuditHash(ctx)
+	if err != nil {
+		return err
+	}
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Actor:     a.actor(ctx),
+		Operation: op,
+		Before:    before,
+		After:     after,
+		PrevHash:  prevHash,
+	}
+	entry.Hash, err = a.auditHash(entry)
+	if err != nil {
+		return err
+	}
+	doc := map[string]interface{}{
+		"time":      entry.Time,
+		"operation": entry.Operation,
+		"hash":      entry.Hash,
+	}
+	if entry.Actor != "" {
+		doc["actor"] = entry.Actor
+	}
+	if len(before) > 0 {
+		doc["before"] = before
+	}
+	if len(after) > 0 {
+		doc["after"] = after
+	}
+	if prevHash != "" {
+		doc["prevHash"] = prevHash
+	}
+	a.stampScope(doc)
+	_, err = a.audit.CreateDocument(ctx, doc)
+	return err
+}
+
+// lastAuditHash returns hash of the newest audit log entry of adapter scope.
+func (a *adapter) lastAuditHash(ctx context.Context) (string, error) {
+	query := fmt.Sprintf("FOR e IN %s FILTER %s SORT e._key DESC LIMIT 1 RETURN e.hash",
+		a.auditName, a.scopeFilter("e"))
+	cursor, err := a.database.Query(ctx, query, nil)
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+	var hash string
+	_, err = cursor.ReadDocument(ctx, &hash)
+	if arango.IsNoMoreDocuments(err) {
+		return "", nil
+	}
+	return hash, err
+}
+
+// auditHash returns hash of entry content including hash of preceding entry; it is HMAC keyed
+// with audit key if one is set.
+func (a *adapter) auditHash(entry AuditEntry) (string, error) {
+	entry.Key = ""
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	if len(a.auditKey) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, a.auditKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// storedRules returns rules currently stored by adapter. It is called within transaction of
+// change so result reflects exactly what is being replaced.
+func (a *adapter) storedRules(ctx context.Context) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	read := func(key string, line policyLine, err error) error {
+		if err != nil {
+			// invalid documents are dropped by SavePolicy anyway
+			return nil
+		}
+		rules = append(rules, PolicyRule{Sec: line.sec, PType: line.ptype, Rule: line.rule})
+		return nil
+	}
+	if err := a.readPolicy(ctx, a.query, nil, read); err != nil {
+		return nil, err
+	}
+	if a.edges != nil {
+		if err := a.readPolicy(ctx, a.graphQuery, nil, read); err != nil {
+			return nil, err
+		}
+	}
+	if a.validity {
+		stored, err := a.storedValidity(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rules = withValidity(rules, stored)
+	}
+	return rules, nil
+}
+
+// policyRules converts lines to rules.
+func policyRules(lines []policyLine) []PolicyRule {
+	rules := make([]PolicyRule, 0, len(lines))
+	for _, l := range lines {
+		rules = append(rules, PolicyRule{Sec: l.sec, PType: l.ptype, Rule: l.rule})
+	}
+	return rules
+}
+
+// diffRules returns rules of from missing in to (removed) and rules of to missing in from
+// (added). Duplicated rules are counted.
+func diffRules(from []PolicyRule, to []PolicyRule) (removed []PolicyRule, added []PolicyRule) {
+	count := make(map[string]int)
+	for _, r := range from {
+		count[policyKey(r.Sec, r.PType, r.Rule)]++
+	}
+	for _, r := range to {
+		key := policyKey(r.Sec, r.PType, r.Rule)
+		if count[key] > 0 {
+			count[key]--
+			continue
+		}
+		added = append(added, r)
+	}
+	for _, r := range from {
+		key := policyKey(r.Sec, r.PType, r.Rule)
+		if count[key] > 0 {
+			count[key]--
+			removed = append(removed, r)
+		}
+	}
+	return removed, added
+}
+
+// auditSave records rules removed and added by replacing stored rules with saved ones.
+func (a *adapter) auditSave(ctx context.Context, stored []PolicyRule, saved []PolicyRule) error {
+	removed, added := diffRules(stored, saved)
+	if len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+	return a.auditChange(ctx, SaveOperation, removed, added)
+}
+
+// AuditLog returns up to limit audit log entries recorded after entry with given key, oldest
+// first. Empty key starts from the beginning of the log; key of last returned entry fetches
+// next page.
+func (a *adapter) AuditLog(after string, limit int) ([]AuditEntry, error) {
+	entries, err := a.auditLog(after, limit)
+	return entries, wrapError(LoadOperation, "", nil, err)
+}
+
+func (a *adapter) auditLog(after string, limit int) ([]AuditEntry, error) {
+	if a.auditName == "" {
+		return nil, ErrAuditOff
+	}
+	if err := a.ensureReady(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("FOR e IN %s FILTER %s && e._key > @after SORT e._key LIMIT @limit RETURN e",
+		a.auditName, a.scopeFilter("e"))
+	cursor, err := a.database.Query(context.Background(), query, map[string]interface{}{
+		"after": after,
+		"limit": limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	entries := []AuditEntry{}
+	for {
+		var entry AuditEntry
+		_, err := cursor.ReadDocument(context.Background(), &entry)
+		if arango.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// VerifyAuditLog checks hash chain of audit log. ErrAuditTampered is returned if any entry has
+// been modified, removed or inserted other than by adapter. Without OpAuditKey this detects only
+// edits not followed by recomputing hashes of later entries; removal of the newest entries can
+// not be detected either way.
+func (a *adapter) VerifyAuditLog() error {
+	return wrapError(LoadOperation, "", nil, a.verifyAuditLog())
+}
+
+func (a *adapter) verifyAuditLog() error {
+	if a.auditName == "" {
+		return ErrAuditOff
+	}
+	if err := a.ensureReady(); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("FOR e IN %s FILTER %s SORT e._key RETURN e", a.auditName, a.scopeFilter("e"))
+	cursor, err := a.database.Query(a.queryContext(context.Background()), query, nil)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	prevHash := ""
+	for {
+		var entry AuditEntry
+		_, err := cursor.ReadDocument(context.Background(), &entry)
+		if arango.IsNoMoreDocuments(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		hash, err := a.auditHash(entry)
+		if err != nil {
+			return err
+		}
+		if entry.PrevHash != prevHash || entry.Hash != hash {
+			return fmt.Errorf("%w: entry %s", ErrAuditTampered, entry.Key)
+		}
+		prevHash = entry.Hash
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+var (
+	ErrUnauthorized error = errors.New("database access denied")
+	ErrUnavailable  error = errors.New("database unavailable")
+)
+
+// Operation names adapter call that failed.
+type Operation string
+
+const (
+	LoadOperation   Operation = "load"
+	SaveOperation   Operation = "save"
+	AddOperation    Operation = "add"
+	RemoveOperation Operation = "remove"
+)
+
+// Error is returned by all policy operations of adapter. It may be matched with errors.Is against
+// ErrPolicyNotFound, ErrPolicyExists, ErrUnauthorized, ErrUnavailable and ErrInvalidPolicyDocument
+// regardless of whether failure has been detected by adapter or reported by database.
+type Error struct {
+	// Op is an operation that failed
+	Op Operation
+	// PType is a ptype of rule being processed; empty for operations on whole policy
+	PType string
+	// Rule is a rule (or filter values) being processed; empty for operations on whole policy
+	Rule []string
+	// ErrorNum is an ArangoDB error number; zero if error has not been reported by database
+	ErrorNum int
+	// Err is an underlying error
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.PType == "" {
+		return fmt.Sprintf("arangodb adapter: %s: %s", e.Op, e.Err)
+	}
+	return fmt.Sprintf("arangodb adapter: %s %s %v: %s", e.Op, e.PType, e.Rule, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is classifies database errors so they match adapter sentinel errors.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrPolicyNotFound:
+		// 1202 is ERROR_ARANGO_DOCUMENT_NOT_FOUND
+		return arango.IsArangoErrorWithErrorNum(e.Err, 1202)
+	case ErrPolicyExists:
+		return arango.IsConflict(e.Err)
+	case ErrUnauthorized:
+		return arango.IsUnauthorized(e.Err) || arango.IsForbidden(e.Err)
+	case ErrUnavailable:
+		return isUnavailable(e.Err)
+	case ErrInvalidPolicyDocument:
+		// 1620 is ERROR_VALIDATION_FAILED - document rejected by collection schema
+		return arango.IsArangoErrorWithErrorNum(e.Err, 1620)
+	}
+	return false
+}
+
+func isUnavailable(err error) bool {
+	var urlErr *url.Error
+	var netErr *net.OpError
+	return errors.As(err, &urlErr) || errors.As(err, &netErr) ||
+		arango.IsResponse(err) || arango.IsTimeout(err) || arango.IsNoLeaderOrOngoing(err) ||
+		arango.IsArangoErrorWithCode(err, 503)
+}
+
+// wrapError turns err into *Error describing failed operation; nil is returned as is.
+func wrapError(op Operation, ptype string, rule []string, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Op: op, PType: ptype, Rule: rule, Err: err}
+	if ae, ok := arango.AsArangoError(err); ok {
+		e.ErrorNum = ae.ErrorNum
+	}
+	return e
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"container/list"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+var (
+	ErrInvalidTenant      error = errors.New("invalid tenant id")
+	ErrSharedSnapshotPath error = errors.New("snapshot path of adapter factory must contain tenant placeholder")
+)
+
+// TenantPlaceholder is replaced with tenant id in names configured for AdapterFactory.
+const TenantPlaceholder = "{tenant}"
+
+// TenantField is a scope attribute holding tenant id when names configured for AdapterFactory
+// make tenants share collection.
+const TenantField = "Tenant"
+
+// tenantPattern matches tenant ids that are safe as part of database, collection and file names.
+var tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// AdapterFactory hands out adapters of many tenants, each using its own database and/or collection,
+// all sharing single client (and its connections) to ArangoDB. Adapters are created lazily on first
+// request and cached; least recently used ones are evicted when cache is full. If configured names
+// do not separate tenants, adapters share collection and are scoped with TenantField (see OpScope).
+type AdapterFactory struct {
+	client         arango.Client
+	options        []adapterOption
+	dbName         string
+	collectionName string
+	cacheSize      int
+	shared         bool
+
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// factoryEntry is cached adapter of single tenant. Adapter is created outside of factory lock
+// so tenants do not wait for each other.
+type factoryEntry struct {
+	tenant  string
+	once    sync.Once
+	adapter Adapter
+	err     error
+}
+
+type factoryOption func(*AdapterFactory)
+
+// FactoryOpAdapterOptions configures options applied to every adapter handed out by factory.
+// Endpoints and credentials are used to create shared client; names of database, collection and
+// snapshot may contain TenantPlaceholder. Options applied by factory itself take precedence.
+func FactoryOpAdapterOptions(options ...adapterOption) func(*AdapterFactory) {
+	return func(f *AdapterFactory) {
+		f.options = append(f.options, options...)
+	}
+}
+
+// FactoryOpDatabaseName configures template of database name of tenant; default is "casbin"
+// which keeps all tenants in one database.
+func FactoryOpDatabaseName(template string) func(*AdapterFactory) {
+	return func(f *AdapterFactory) {
+		f.dbName = template
+	}
+}
+
+// FactoryOpCollectionName configures template of collection name of tenant; default is
+// "casbin_rules_{tenant}".
+func FactoryOpCollectionName(template string) func(*AdapterFactory) {
+	return func(f *AdapterFactory) {
+		f.collectionName = template
+	}
+}
+
+// FactoryOpCacheSize configures how many adapters are cached; default is 0 meaning no limit.
+func FactoryOpCacheSize(size int) func(*AdapterFactory) {
+	return func(f *AdapterFactory) {
+		f.cacheSize = size
+	}
+}
+
+// NewAdapterFactory creates factory and client shared by all adapters it hands out.
+func NewAdapterFactory(options ...factoryOption) (*AdapterFactory, error) {
+	f := AdapterFactory{}
+	f.dbName = "casbin"
+	f.collectionName = "casbin_rules_" + TenantPlaceholder
+	f.lru = list.New()
+	f.entries = make(map[string]*list.Element)
+
+	for _, option := range options {
+		option(&f)
+	}
+
+	a, err := newAdapter(f.options...)
+	if err != nil {
+		return nil, err
+	}
+	if a.snapshotPath != "" && !strings.Contains(a.snapshotPath, TenantPlaceholder) {
+		return nil, ErrSharedSnapshotPath
+	}
+	collectionName := f.collectionName
+	if a.ptypePrefix != "" {
+		collectionName = a.ptypePrefix
+	}
+	f.shared = !strings.Contains(f.dbName, TenantPlaceholder) && !strings.Contains(collectionName, TenantPlaceholder)
+	f.client, err = a.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Adapter returns adapter of given tenant, creating it (and, in autocreate mode, its database and
+// collection) on first use. Failed creation is not cached so it is retried on next call. Tenant id
+// may contain only letters, digits, underscores and hyphens (at most 64 of them).
+func (f *AdapterFactory) Adapter(tenant string) (Adapter, error) {
+	if !tenantPattern.MatchString(tenant) {
+		return nil, ErrInvalidTenant
+	}
+	f.lock.Lock()
+	el, ok := f.entries[tenant]
+	if ok {
+		f.lru.MoveToFront(el)
+	} else {
+		el = f.lru.PushFront(&factoryEntry{tenant: tenant})
+		f.entries[tenant] = el
+		if f.cacheSize > 0 && f.lru.Len() > f.cacheSize {
+			f.remove(f.lru.Back())
+		}
+	}
+	f.lock.Unlock()
+
+	e := el.Value.(*factoryEntry)
+	e.once.Do(func() {
+		e.adapter, e.err = f.newAdapter(tenant)
+	})
+	if e.err != nil {
+		f.lock.Lock()
+		if f.entries[tenant] == el {
+			f.remove(el)
+		}
+		f.lock.Unlock()
+		return nil, e.err
+	}
+	return e.adapter, nil
+}
+
+// Evict removes adapter of given tenant from cache. Adapter itself stays usable by its holders;
+// next call of Adapter creates new one.
+func (f *AdapterFactory) Evict(tenant string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if el, ok := f.entries[tenant]; ok {
+		f.remove(el)
+	}
+}
+
+// Len returns number of cached adapters.
+func (f *AdapterFactory) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lru.Len()
+}
+
+// remove drops cache element; factory lock must be held.
+func (f *AdapterFactory) remove(el *list.Element) {
+	f.lru.Remove(el)
+	delete(f.entries, el.Value.(*factoryEntry).tenant)
+}
+
+func (f *AdapterFactory) newAdapter(tenant string) (Adapter, error) {
+	options := append([]adapterOption{}, f.options...)
+	options = append(options,
+		OpDatabaseName(strings.ReplaceAll(f.dbName, TenantPlaceholder, tenant)),
+		OpCollectionName(strings.ReplaceAll(f.collectionName, TenantPlaceholder, tenant)),
+		func(a *adapter) {
+			a.snapshotPath = strings.ReplaceAll(a.snapshotPath, TenantPlaceholder, tenant)
+			a.ptypePrefix = strings.ReplaceAll(a.ptypePrefix, TenantPlaceholder, tenant)
+			if f.shared {
+				scope := make(map[string]string, len(a.scope)+1)
+				for name, value := range a.scope {
+					scope[name] = value
+				}
+				scope[TenantField] = tenant
+				a.scope = scope
+			}
+		},
+	)
+	a, err := newAdapter(options...)
+	if err != nil {
+		return nil, err
+	}
+	return openAdapter(f.client, a, options)
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"fmt"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+// graphSection is a model section stored as edges in graph storage mode.
+const graphSection = "g"
+
+// isGraphSection reports whether rules of given section are stored as edges.
+func (a *adapter) isGraphSection(sec string) bool {
+	return a.graphEdges != "" && sec == graphSection
+}
+
+// ensureCollection returns collection of adapter database with given name, creating it first
+// (with given options) in autocreate mode.
+func (a *adapter) ensureCollection(name string, options *arango.CreateCollectionOptions) (arango.Collection, error) {
+	if a.autocreate {
+		ex, err := a.database.CollectionExists(context.Background(), name)
+		if err != nil {
+			return nil, err
+		}
+		if !ex {
+			_, err := a.database.CreateCollection(context.Background(), name, options)
+			// 1207 is ERROR_ARANGO_DUPLICATE_NAME: collection has been created in the meantime
+			if err != nil && !arango.IsArangoErrorWithErrorNum(err, 1207) {
+				return nil, err
+			}
+		}
+	}
+	return a.database.Collection(context.Background(), name)
+}
+
+// initializeGraph prepares collections (and optionally named graph) of graph storage mode.
+func (a *adapter) initializeGraph() error {
+	if a.graphName != "" && a.autocreate {
+		ex, err := a.database.GraphExists(context.Background(), a.graphName)
+		if err != nil {
+			return err
+		}
+		if !ex {
+			_, err := a.database.CreateGraph(context.Background(), a.graphName, &arango.CreateGraphOptions{
+				EdgeDefinitions: []arango.EdgeDefinition{{
+					Collection: a.graphEdges,
+					From:       []string{a.graphVertices},
+					To:         []string{a.graphVertices},
+				}},
+			})
+			// 1925 is ERROR_GRAPH_DUPLICATE: graph has been created in the meantime
+			if err != nil && !arango.IsArangoErrorWithErrorNum(err, 1925) {
+				return err
+			}
+		}
+	}
+	vertices, err := a.ensureCollection(a.graphVertices, nil)
+	if err != nil {
+		return err
+	}
+	edges, err := a.ensureCollection(a.graphEdges, &arango.CreateCollectionOptions{Type: arango.CollectionTypeEdge})
+	if err != nil {
+		return err
+	}
+	_, _, err = edges.EnsureHashIndex(context.Background(),
+		a.indexFields(), &arango.EnsureHashIndexOptions{
+			Unique: true,
+			Sparse: true,
+		})
+	if err != nil {
+		return err
+	}
+	if err = a.checkScopedIndexes(edges); err != nil {
+		return err
+	}
+	a.vertices = vertices
+	a.edges = edges
+	return nil
+}
+
+// linkEdge turns policy document of grouping rule into edge leading from vertex of its first
+// value to vertex of its second value.
+func (a *adapter) linkEdge(doc map[string]interface{}, rule []string) error {
+	if len(rule) < 2 {
+		return fmt.Errorf("%w: grouping rule needs at least two values", ErrInvalidPolicyDocument)
+	}
+	doc["_from"] = a.graphVertices + "/" + vertexKey(rule[0])
+	doc["_to"] = a.graphVertices + "/" + vertexKey(rule[1])
+	return nil
+}
+
+// writeEdges writes edge documents together with vertices they connect and returns number of
+// edges actually created (ones with existing keys are skipped in overwrite mode ignore). Vertices
+// are shared by many edges so already existing ones are left intact.
+func (a *adapter) writeEdges(ctx context.Context, lines []policyLine, docs []interface{}) (int, error) {
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	vertices := make([]interface{}, 0, 2*len(lines))
+	seen := make(map[string]bool, 2*len(lines))
+	for _, l := range lines {
+		for _, name := range l.rule[:2] {
+			if !seen[name] {
+				seen[name] = true
+				vertices = append(vertices, map[string]interface{}{"_key": vertexKey(name), nameField: name})
+			}
+		}
+	}
+	_, errs, err := a.vertices.CreateDocuments(
+		arango.WithOverwriteMode(ctx, arango.OverwriteModeIgnore), vertices)
+	if err != nil {
+		return 0, err
+	}
+	if err = errs.FirstNonNil(); err != nil {
+		return 0, err
+	}
+	if a.overwriteMode != arango.OverwriteModeIgnore {
+		_, errs, err = a.edges.CreateDocuments(ctx, docs)
+		if err == nil {
+			err = errs.FirstNonNil()
+		}
+		return len(docs), err
+	}
+	// new version of edge is returned only if it has been created
+	created := make([]map[string]interface{}, len(docs))
+	_, errs, err = a.edges.CreateDocuments(arango.WithReturnNew(ctx, created), docs)
+	if err == nil {
+		err = errs.FirstNonNil()
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, edge := range created {
+		if edge != nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// revision returns revision of all collections holding policy.
+func (a *adapter) revision() (string, error) {
+	revision, err := a.collection.Revision(context.Background())
+	if err != nil || a.edges == nil {
+		return revision, err
+	}
+	edgesRevision, err := a.edges.Revision(context.Background())
+	return revision + "/" + edgesRevision, err
+}
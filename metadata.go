@@ -0,0 +1,164 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+var ErrMetadataOff error = errors.New("rule metadata is not enabled")
+
+// metadataField is a name of attribute holding rule metadata.
+const metadataField = "Metadata"
+
+// Metadata describes who added a rule, when and why.
+type Metadata struct {
+	// CreatedAt is a time rule has been added; set by adapter if zero
+	CreatedAt time.Time `json:"createdAt"`
+	// CreatedBy identifies author of the rule
+	CreatedBy string `json:"createdBy,omitempty"`
+	// Reason is a free form comment explaining why rule has been added
+	Reason string `json:"reason,omitempty"`
+	// Labels are custom attributes of the rule
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type metadataKey struct{}
+
+// ContextWithMetadata returns context carrying metadata of rules added with AddPolicyContext.
+func ContextWithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// metadata returns metadata of rule being added: one attached to context or, if there is none,
+// one supplied by provider configured with OpMetadata.
+func (a *adapter) metadata(ctx context.Context) Metadata {
+	md, ok := ctx.Value(metadataKey{}).(Metadata)
+	if !ok && a.metadataFn != nil {
+		md = a.metadataFn()
+	}
+	if md.CreatedAt.IsZero() {
+		md.CreatedAt = time.Now().UTC()
+	}
+	return md
+}
+
+// storedMetadata returns metadata of all stored rules of adapter, keyed by policyKey. Context
+// carries transaction of the change, if any, so rules are read consistently with the write.
+func (a *adapter) storedMetadata(ctx context.Context) (map[string]interface{}, error) {
+	return a.storedValues(ctx, fmt.Sprintf("d.%s != null", metadataField), "d."+metadataField)
+}
+
+// storedValues returns value of AQL expression evaluated for every stored rule (document d)
+// matching condition, keyed by policyKey.
+func (a *adapter) storedValues(ctx context.Context, cond string, value string) (map[string]interface{}, error) {
+	stored := make(map[string]interface{})
+	queries := []string{fmt.Sprintf(`FOR d IN %s FILTER %s && %s RETURN APPEND(%s, [%s])`,
+		a.collectionName, a.liveFilter, cond, a.projection("d"), value)}
+	if a.edges != nil {
+		queries = append(queries, fmt.Sprintf(`FOR d IN %s FILTER %s && %s RETURN APPEND(%s, [%s])`,
+			a.graphEdges, a.scopeFilter("d"), cond, a.projection("d"), value))
+	}
+	for _, query := range queries {
+		if err := a.readStoredValues(ctx, query, stored); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// readStoredValues runs single query of storedValues and adds its results to stored.
+func (a *adapter) readStoredValues(ctx context.Context, query string, stored map[string]interface{}) error {
+	cursor, err := a.database.Query(a.queryContext(ctx), query, nil)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	for {
+		var row []interface{}
+		_, err := cursor.ReadDocument(ctx, &row)
+		if arango.IsNoMoreDocuments(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line, err := a.decodePolicyLine(row[:len(row)-1])
+		if err != nil {
+			// invalid documents are dropped by SavePolicy anyway
+			continue
+		}
+		stored[policyKey(line.sec, line.ptype, line.rule)] = row[len(row)-1]
+	}
+}
+
+// attachMetadata sets metadata of documents being saved: stored one if rule already existed,
+// otherwise new one.
+func (a *adapter) attachMetadata(lines []policyLine, docs []interface{}, stored map[string]interface{}) {
+	for i, l := range lines {
+		doc := docs[i].(map[string]interface{})
+		if md, ok := stored[policyKey(l.sec, l.ptype, l.rule)]; ok {
+			doc[metadataField] = md
+		} else {
+			doc[metadataField] = a.metadata(context.Background())
+		}
+	}
+}
+
+// GetPolicyMetadata returns metadata stored with a rule. ErrPolicyNotFound is returned if there
+// is no such rule; rules stored before metadata has been enabled have empty metadata.
+func (a *adapter) GetPolicyMetadata(sec string, ptype string, rule []string) (Metadata, error) {
+	md, err := a.getPolicyMetadata(sec, ptype, rule)
+	return md, wrapError(LoadOperation, ptype, rule, err)
+}
+
+func (a *adapter) getPolicyMetadata(sec string, ptype string, rule []string) (Metadata, error) {
+	if !a.metadataOn {
+		return Metadata{}, ErrMetadataOff
+	}
+	if 1+len(rule) > len(a.mapping) {
+		return Metadata{}, ErrTooManyArguments
+	}
+	if err := a.ensureReady(); err != nil {
+		return Metadata{}, err
+	}
+	filter, bindings := a.ruleFilter(sec, ptype, rule)
+	query := fmt.Sprintf("FOR d IN %s FILTER %s && %s LIMIT 1 RETURN d.%s",
+		a.collectionName, a.liveFilter, filter, metadataField)
+	if a.isGraphSection(sec) {
+		query = fmt.Sprintf("FOR d IN %s FILTER %s && %s LIMIT 1 RETURN d.%s",
+			a.graphEdges, a.scopeFilter("d"), filter, metadataField)
+	}
+	cursor, err := a.database.Query(context.Background(), query, bindings)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer cursor.Close()
+	var md *Metadata
+	_, err = cursor.ReadDocument(context.Background(), &md)
+	if arango.IsNoMoreDocuments(err) {
+		return Metadata{}, ErrPolicyNotFound
+	} else if err != nil {
+		return Metadata{}, err
+	}
+	if md == nil {
+		return Metadata{}, nil
+	}
+	return *md, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	arango "github.com/arangodb/go-driver"
+	"github.com/casbin/casbin/v2/model"
+)
+
+// partBuffer is a number of decoded rows of a key range buffered until preceding ranges are
+// applied; it bounds memory used by parallel load regardless of collection size.
+const partBuffer = 1000
+
+// keyedLine is a decoded row passed from reader of a key range to model.
+type keyedLine struct {
+	key  string
+	line policyLine
+	err  error
+}
+
+// keyBoundaries returns sorted document keys splitting collection into parts of similar size.
+// Returned slice may be shorter than parts-1 if collection is small.
+func (a *adapter) keyBoundaries(parts int) ([]string, error) {
+	count, err := a.count()
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, 0, parts-1)
+	for i := 1; i < parts; i++ {
+		if offset := count * int64(i) / int64(parts); offset > 0 {
+			offsets = append(offsets, offset)
+		}
+	}
+	query := fmt.Sprintf("FOR o IN @offsets RETURN FIRST(FOR d IN %s FILTER %s SORT d._key LIMIT o, 1 RETURN d._key)",
+		a.collectionName, a.scopeFilter("d"))
+	cursor, err := a.database.Query(context.Background(), query, map[string]interface{}{
+		"offsets": offsets,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	bounds := make([]string, 0, len(offsets))
+	for {
+		var key *string
+		_, err := cursor.ReadDocument(context.Background(), &key)
+		if arango.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// key may be missing if documents were removed after counting; duplicates
+		// appear when there are fewer documents than parts
+		if key != nil && (len(bounds) == 0 || bounds[len(bounds)-1] != *key) {
+			bounds = append(bounds, *key)
+		}
+	}
+	return bounds, nil
+}
+
+// count returns number of documents in adapter scope.
+func (a *adapter) count() (int64, error) {
+	if len(a.scope) == 0 {
+		return a.collection.Count(context.Background())
+	}
+	query := fmt.Sprintf("FOR d IN %s FILTER %s COLLECT WITH COUNT INTO n RETURN n", a.collectionName, a.scopeFilter("d"))
+	cursor, err := a.database.Query(context.Background(), query, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var n int64
+	_, err = cursor.ReadDocument(context.Background(), &n)
+	return n, err
+}
+
+// loadPolicyParallel reads key ranges concurrently and applies them to model sequentially, range
+// after range, so model gets rules ordered by document key. Rows of the range being applied are
+// applied as they arrive while readers of later ranges wait once their buffers are full.
+func (a *adapter) loadPolicyParallel(model model.Model) error {
+	bounds, err := a.keyBoundaries(a.workers)
+	if err != nil {
+		return err
+	}
+
+	// cancelled when applying fails so readers blocked on full buffers quit
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	parts := make([]chan keyedLine, len(bounds)+1)
+	errs := make([]error, len(bounds)+1)
+	for i := range parts {
+		bindings := make(map[string]interface{})
+		comp := []string{"true"}
+		if i > 0 {
+			comp = append(comp, "d._key >= @from")
+			bindings["from"] = bounds[i-1]
+		}
+		if i < len(bounds) {
+			comp = append(comp, "d._key < @to")
+			bindings["to"] = bounds[i]
+		}
+		parts[i] = make(chan keyedLine, partBuffer)
+		go func(i int, query string, bindings map[string]interface{}) {
+			defer close(parts[i])
+			errs[i] = a.readPolicy(ctx, query, bindings, func(key string, line policyLine, err error) error {
+				select {
+				case parts[i] <- keyedLine{key: key, line: line, err: err}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}(i, fmt.Sprintf(a.queryRange, strings.Join(comp, " && ")), bindings)
+	}
+
+	for i, part := range parts {
+		for l := range part {
+			if err := a.applyPolicyLine(model, l.key, l.line, l.err); err != nil {
+				return err
+			}
+		}
+		// error is set before channel is closed
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+	return nil
+}
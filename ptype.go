@@ -0,0 +1,368 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	arango "github.com/arangodb/go-driver"
+	"github.com/casbin/casbin/v2/model"
+)
+
+// ptypeRouter is an Adapter keeping rules of every ptype in separate collection. Each collection
+// is handled by regular adapter created on first use of its ptype; all of them share one client.
+type ptypeRouter struct {
+	client  arango.Client
+	config  *adapter
+	options []adapterOption
+
+	lock sync.Mutex
+	subs map[string]*adapter
+}
+
+func newPTypeRouter(client arango.Client, config *adapter, options []adapterOption) *ptypeRouter {
+	return &ptypeRouter{
+		client:  client,
+		config:  config,
+		options: options,
+		subs:    make(map[string]*adapter),
+	}
+}
+
+// sub returns adapter of collection holding rules of ptype, creating it if needed.
+func (r *ptypeRouter) sub(ptype string) (*adapter, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if a, ok := r.subs[ptype]; ok {
+		return a, nil
+	}
+	options := append([]adapterOption{}, r.options...)
+	options = append(options, OpCollectionName(r.config.ptypePrefix+ptype), func(a *adapter) {
+		a.ptypePrefix = ""
+		a.ptype = ptype
+		if a.snapshotPath != "" {
+			a.snapshotPath += "." + ptype
+		}
+	})
+	a, err := newAdapter(options...)
+	if err != nil {
+		return nil, err
+	}
+	a.client = r.client
+	if err = a.open(); err != nil {
+		return nil, err
+	}
+	r.subs[ptype] = a
+	return a, nil
+}
+
+// loaded returns adapters created so far, ordered by ptype.
+func (r *ptypeRouter) loaded() []*adapter {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ptypes := make([]string, 0, len(r.subs))
+	for ptype := range r.subs {
+		ptypes = append(ptypes, ptype)
+	}
+	sort.Strings(ptypes)
+	subs := make([]*adapter, 0, len(ptypes))
+	for _, ptype := range ptypes {
+		subs = append(subs, r.subs[ptype])
+	}
+	return subs
+}
+
+// isMissingCollection reports whether err has been caused by collection that does not exist.
+func isMissingCollection(err error) bool {
+	// 1203 is ERROR_ARANGO_DATA_SOURCE_NOT_FOUND; missing database is reported as 1228 instead
+	return arango.IsArangoErrorWithErrorNum(err, 1203)
+}
+
+// policyTypes returns sections and ptypes of policy rules defined in model, ordered by section
+// and ptype. Rules of returned lines are empty.
+func policyTypes(model model.Model) []policyLine {
+	var types []policyLine
+	for _, sec := range []string{"p", "g"} {
+		ptypes := make([]string, 0, len(model[sec]))
+		for ptype := range model[sec] {
+			ptypes = append(ptypes, ptype)
+		}
+		sort.Strings(ptypes)
+		for _, ptype := range ptypes {
+			types = append(types, policyLine{sec: sec, ptype: ptype})
+		}
+	}
+	return types
+}
+
+// LoadPolicy loads rules of all ptypes defined in model from their collections. Collections
+// that do not exist (and are not created as autocreate is off) are treated as empty.
+func (r *ptypeRouter) LoadPolicy(model model.Model) error {
+	for _, t := range policyTypes(model) {
+		ptype := t.ptype
+		a, err := r.sub(ptype)
+		if isMissingCollection(err) {
+			continue
+		}
+		if err != nil {
+			return wrapError(LoadOperation, ptype, nil, err)
+		}
+		if err = a.LoadPolicy(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SavePolicy replaces rules in collections of all ptypes defined in model. Collections are written
+// one after another so failure may leave some of them already replaced.
+func (r *ptypeRouter) SavePolicy(model model.Model) error {
+	for _, t := range policyTypes(model) {
+		a, err := r.sub(t.ptype)
+		if err == nil {
+			err = a.ensureReady()
+		}
+		if err != nil {
+			return wrapError(SaveOperation, t.ptype, nil, err)
+		}
+		policy := model[t.sec][t.ptype].Policy
+		lines := make([]policyLine, 0, len(policy))
+		for _, rule := range policy {
+			lines = append(lines, policyLine{sec: t.sec, ptype: t.ptype, rule: rule})
+		}
+		if err = a.saveLines(lines, nil); err != nil {
+			return wrapError(SaveOperation, t.ptype, nil, err)
+		}
+	}
+	return nil
+}
+
+// AddPolicy adds a policy rule to collection of its ptype.
+func (r *ptypeRouter) AddPolicy(sec string, ptype string, rule []string) error {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return wrapError(AddOperation, ptype, rule, err)
+	}
+	return a.AddPolicy(sec, ptype, rule)
+}
+
+// RemovePolicy removes a policy rule from collection of its ptype.
+func (r *ptypeRouter) RemovePolicy(sec string, ptype string, rule []string) error {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return wrapError(RemoveOperation, ptype, rule, err)
+	}
+	return a.RemovePolicy(sec, ptype, rule)
+}
+
+// RemovePolicyCount removes a policy rule from collection of its ptype and returns number of
+// removed documents.
+func (r *ptypeRouter) RemovePolicyCount(sec string, ptype string, rule []string) (int, error) {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return 0, wrapError(RemoveOperation, ptype, rule, err)
+	}
+	return a.RemovePolicyCount(sec, ptype, rule)
+}
+
+// RemoveFilteredPolicy removes policy rules that match the filter from collection of ptype.
+func (r *ptypeRouter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return wrapError(RemoveOperation, ptype, fieldValues, err)
+	}
+	return a.RemoveFilteredPolicy(sec, ptype, fieldIndex, fieldValues...)
+}
+
+// RemoveFilteredPolicyCount removes policy rules that match the filter from collection of ptype
+// and returns number of removed documents.
+func (r *ptypeRouter) RemoveFilteredPolicyCount(sec string, ptype string, fieldIndex int, fieldValues ...string) (int, error) {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return 0, wrapError(RemoveOperation, ptype, fieldValues, err)
+	}
+	return a.RemoveFilteredPolicyCount(sec, ptype, fieldIndex, fieldValues...)
+}
+
+// RemoveFilteredPolicyRules removes policy rules that match the filter from collection of ptype
+// and returns them.
+func (r *ptypeRouter) RemoveFilteredPolicyRules(sec string, ptype string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return nil, wrapError(RemoveOperation, ptype, fieldValues, err)
+	}
+	return a.RemoveFilteredPolicyRules(sec, ptype, fieldIndex, fieldValues...)
+}
+
+// VerifySchema checks documents of collections of ptypes used so far by this adapter. Other
+// collections sharing the prefix (e.g. audit log or role graph) are never touched.
+func (r *ptypeRouter) VerifySchema() ([]SchemaViolation, error) {
+	violations := []SchemaViolation{}
+	for _, a := range r.loaded() {
+		v, err := a.VerifySchema()
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, v...)
+	}
+	return violations, nil
+}
+
+// Changed reports whether any collection read by previous LoadPolicy has been modified since.
+func (r *ptypeRouter) Changed() (bool, error) {
+	subs := r.loaded()
+	if len(subs) == 0 {
+		return true, nil
+	}
+	for _, a := range subs {
+		changed, err := a.Changed()
+		if err != nil || changed {
+			return changed, err
+		}
+	}
+	return false, nil
+}
+
+// LoadPolicyIfChanged replaces policy of model with one loaded from collections of all ptypes if
+// any of them has been modified since last load.
+func (r *ptypeRouter) LoadPolicyIfChanged(model model.Model) (bool, error) {
+	changed, err := r.Changed()
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, reloadPolicy(model, "", r.LoadPolicy)
+}
+
+// Degraded reports whether rules of any ptype have been loaded from snapshot.
+func (r *ptypeRouter) Degraded() bool {
+	for _, a := range r.loaded() {
+		if a.Degraded() {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncPolicy applies changes of collections of all ptypes defined in model.
+func (r *ptypeRouter) SyncPolicy(model model.Model) error {
+	if !r.config.tracking {
+		return wrapError(LoadOperation, "", nil, ErrChangeTrackingOff)
+	}
+	for _, t := range policyTypes(model) {
+		ptype := t.ptype
+		a, err := r.sub(ptype)
+		if isMissingCollection(err) {
+			continue
+		}
+		if err != nil {
+			return wrapError(LoadOperation, ptype, nil, err)
+		}
+		if err = a.SyncPolicy(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPolicyContext adds a policy rule with metadata from context to collection of its ptype.
+func (r *ptypeRouter) AddPolicyContext(ctx context.Context, sec string, ptype string, rule []string) error {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return wrapError(AddOperation, ptype, rule, err)
+	}
+	return a.AddPolicyContext(ctx, sec, ptype, rule)
+}
+
+// GetPolicyMetadata returns metadata of a rule stored in collection of its ptype.
+func (r *ptypeRouter) GetPolicyMetadata(sec string, ptype string, rule []string) (Metadata, error) {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return Metadata{}, wrapError(LoadOperation, ptype, rule, err)
+	}
+	return a.GetPolicyMetadata(sec, ptype, rule)
+}
+
+// AuditLog returns entries of audit log shared by collections of all ptypes.
+func (r *ptypeRouter) AuditLog(after string, limit int) ([]AuditEntry, error) {
+	if r.config.auditName == "" {
+		return nil, wrapError(LoadOperation, "", nil, ErrAuditOff)
+	}
+	a, err := r.auditSub()
+	if err != nil {
+		return nil, wrapError(LoadOperation, "", nil, err)
+	}
+	return a.AuditLog(after, limit)
+}
+
+// auditSub returns any adapter of router; all of them share the same audit log.
+func (r *ptypeRouter) auditSub() (*adapter, error) {
+	if subs := r.loaded(); len(subs) > 0 {
+		return subs[0], nil
+	}
+	return r.sub("p")
+}
+
+// VerifyAuditLog checks hash chain of audit log shared by collections of all ptypes.
+func (r *ptypeRouter) VerifyAuditLog() error {
+	if r.config.auditName == "" {
+		return wrapError(LoadOperation, "", nil, ErrAuditOff)
+	}
+	a, err := r.auditSub()
+	if err != nil {
+		return wrapError(LoadOperation, "", nil, err)
+	}
+	return a.VerifyAuditLog()
+}
+
+// Versions is not supported as policy versioning can't be combined with collection per ptype.
+func (r *ptypeRouter) Versions() ([]Version, error) {
+	return nil, wrapError(LoadOperation, "", nil, ErrVersioningOff)
+}
+
+// DiffVersions is not supported as policy versioning can't be combined with collection per ptype.
+func (r *ptypeRouter) DiffVersions(from int, to int) ([]PolicyRule, []PolicyRule, error) {
+	return nil, nil, wrapError(LoadOperation, "", nil, ErrVersioningOff)
+}
+
+// RestoreVersion is not supported as policy versioning can't be combined with collection per ptype.
+func (r *ptypeRouter) RestoreVersion(number int) error {
+	return wrapError(SaveOperation, "", nil, ErrVersioningOff)
+}
+
+// UndeletePolicy brings back removed rule in collection of its ptype.
+func (r *ptypeRouter) UndeletePolicy(sec string, ptype string, rule []string) error {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return wrapError(AddOperation, ptype, rule, err)
+	}
+	return a.UndeletePolicy(sec, ptype, rule)
+}
+
+// AddPolicyWithExpiry adds a policy rule valid until given time to collection of its ptype.
+func (r *ptypeRouter) AddPolicyWithExpiry(sec string, ptype string, rule []string, validUntil time.Time) error {
+	return r.AddPolicyWithValidity(sec, ptype, rule, time.Time{}, validUntil)
+}
+
+// AddPolicyWithValidity adds a policy rule valid between given times to collection of its ptype.
+func (r *ptypeRouter) AddPolicyWithValidity(sec string, ptype string, rule []string, validFrom time.Time, validUntil time.Time) error {
+	a, err := r.sub(ptype)
+	if err != nil {
+		return wrapError(AddOperation, ptype, rule, err)
+	}
+	return a.AddPolicyWithValidity(sec, ptype, rule, validFrom, validUntil)
+}
@@ -0,0 +1,462 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	arango "github.com/arangodb/go-driver"
+	"github.com/casbin/casbin/v2/log"
+	"github.com/casbin/casbin/v2/rbac"
+)
+
+var ErrForeignAdapter error = errors.New("adapter has not been created by NewAdapter")
+
+const nameField = "Name"
+
+// roleManager is a rbac.RoleManager keeping role links as edges between role vertices in ArangoDB.
+// Nothing is cached in memory: every question is answered by graph traversal.
+type roleManager struct {
+	adapter      *adapter
+	verticesName string
+	edgesName    string
+	maxDepth     int
+	ptype        string
+	shared       bool
+	vertices     arango.Collection
+	edges        arango.Collection
+	matchingFunc rbac.MatchingFunc
+	domainFunc   rbac.MatchingFunc
+	logger       log.Logger
+	domainCache  domainCache
+}
+
+// domainCache keeps stored domains and domains matching ones already queried, so domain matching
+// function does not require reading all domains on every query. It is valid as long as revision
+// of edge collection does not change.
+type domainCache struct {
+	lock     sync.Mutex
+	revision string
+	all      []string
+	matching map[string][]string
+}
+
+type roleManagerOption func(*roleManager)
+
+// RmOpMaxDepth configures how many links may be followed by HasLink; default is 10, the same as
+// in casbin default role manager.
+func RmOpMaxDepth(depth int) func(*roleManager) {
+	return func(rm *roleManager) {
+		rm.maxDepth = depth
+	}
+}
+
+// RmOpPType configures ptype of grouping rules ("g", "g2", ...) handled by role manager; default is "g".
+// Role managers of different ptypes may share the same collections.
+func RmOpPType(ptype string) func(*roleManager) {
+	return func(rm *roleManager) {
+		rm.ptype = ptype
+	}
+}
+
+// RmOpVertexCollection configures name of collection holding users and roles; default is "casbin_roles"
+func RmOpVertexCollection(name string) func(*roleManager) {
+	return func(rm *roleManager) {
+		rm.verticesName = name
+	}
+}
+
+// RmOpEdgeCollection configures name of edge collection holding links between users and roles;
+// default is "casbin_role_links"
+func RmOpEdgeCollection(name string) func(*roleManager) {
+	return func(rm *roleManager) {
+		rm.edgesName = name
+	}
+}
+
+// NewRoleManager returns rbac.RoleManager storing role links in ArangoDB graph. It uses database
+// and connection of given adapter; collections are created if adapter has been configured with
+// OpAutocreate. Links are not kept in memory so it is well suited for large role hierarchies.
+// Calls with domain (models with "g = _, _, _") consider only links of that domain, stored in
+// attribute mapped to third rule value, and links of domains matching it by function added with
+// AddDomainMatchingFunc. Calls without domain consider links of all domains.
+//
+// If adapter has been configured with OpGraphStorage role manager reads links from adapter
+// collections and collection options are ignored. Links are then persisted by adapter so Clear,
+// AddLink and DeleteLink do nothing; enforcer should have auto-save enabled.
+func NewRoleManager(a Adapter, options ...roleManagerOption) (rbac.RoleManager, error) {
+	rm := roleManager{}
+	rm.verticesName = "casbin_roles"
+	rm.edgesName = "casbin_role_links"
+	rm.maxDepth = 10
+	rm.ptype = "g"
+	rm.logger = &log.DefaultLogger{}
+
+	for _, option := range options {
+		option(&rm)
+	}
+
+	var err error
+	ad, ok := a.(*adapter)
+	if r, isRouter := a.(*ptypeRouter); isRouter {
+		// with collection per ptype database is reached through adapter of role manager ptype
+		ad, err = r.sub(rm.ptype)
+		if err != nil {
+			return nil, err
+		}
+		ok = true
+	}
+	if !ok {
+		return nil, ErrForeignAdapter
+	}
+	rm.adapter = ad
+
+	err = ad.ensureReady()
+	if err != nil {
+		return nil, err
+	}
+	if ad.edges != nil {
+		rm.verticesName, rm.edgesName = ad.graphVertices, ad.graphEdges
+		rm.vertices, rm.edges = ad.vertices, ad.edges
+		rm.shared = true
+	} else {
+		rm.vertices, err = ad.ensureCollection(rm.verticesName, nil)
+		if err != nil {
+			return nil, err
+		}
+		rm.edges, err = ad.ensureCollection(rm.edgesName, &arango.CreateCollectionOptions{Type: arango.CollectionTypeEdge})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// domains are listed when domain matching function is set
+	if field, err := rm.domainField(); err == nil {
+		_, _, err = rm.edges.EnsurePersistentIndex(context.Background(), []string{field},
+			&arango.EnsurePersistentIndexOptions{Sparse: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &rm, nil
+}
+
+// vertexKey returns _key of vertex representing user or role of given name. Names are hashed
+// as they may contain characters not allowed in keys.
+func vertexKey(name string) string {
+	return hashKey(name)
+}
+
+func (rm *roleManager) vertexID(name string) string {
+	return rm.verticesName + "/" + vertexKey(name)
+}
+
+func (rm *roleManager) linkKey(name1 string, name2 string, domain ...string) string {
+	parts := append(rm.adapter.scopeValues(), rm.ptype, name1, name2)
+	return hashKey(append(parts, domain...)...)
+}
+
+// ptypeField is a name of edge attribute holding ptype; the same as in policy documents.
+func (rm *roleManager) ptypeField() string {
+	return rm.adapter.mapping[0]
+}
+
+// domainField is a name of edge attribute holding domain; the same as third value of grouping
+// rule in policy documents.
+func (rm *roleManager) domainField() (string, error) {
+	if len(rm.adapter.mapping) < 4 {
+		return "", ErrTooManyArguments
+	}
+	return rm.adapter.mapping[3], nil
+}
+
+// edgeFilter returns AQL condition selecting edges (e is an expression of edge) that may be
+// followed by query about given domain and sets its bindings.
+func (rm *roleManager) edgeFilter(e string, bindings map[string]interface{}, domain []string) (string, error) {
+	bindings["ptype"] = rm.ptype
+	cond := fmt.Sprintf("%s.%s == @ptype", e, rm.ptypeField())
+	for _, name := range rm.adapter.scopeFields() {
+		cond += fmt.Sprintf(" && %s[%s] == %s", e, aqlString(name), aqlString(rm.adapter.scope[name]))
+	}
+	if len(domain) == 0 {
+		return cond, nil
+	}
+	if len(domain) > 1 {
+		return "", ErrTooManyArguments
+	}
+	field, err := rm.domainField()
+	if err != nil {
+		return "", err
+	}
+	domains, err := rm.matchingDomains(domain[0])
+	if err != nil {
+		return "", err
+	}
+	bindings["domains"] = domains
+	return fmt.Sprintf("%s && %s.%s IN @domains", cond, e, field), nil
+}
+
+// matchingDomains returns stored domains links of which apply to given domain: the domain itself
+// and, if domain matching function is set, all stored domains matching it. Stored domains are
+// read again only after edge collection has been modified.
+func (rm *roleManager) matchingDomains(domain string) ([]string, error) {
+	if rm.domainFunc == nil {
+		return []string{domain}, nil
+	}
+	revision, err := rm.edges.Revision(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c := &rm.domainCache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.all == nil || c.revision != revision {
+		all, err := rm.GetAllDomains()
+		if err != nil {
+			return nil, err
+		}
+		c.revision, c.all, c.matching = revision, all, make(map[string][]string)
+	}
+	if domains, ok := c.matching[domain]; ok {
+		return domains, nil
+	}
+	domains := []string{domain}
+	for _, d := range c.all {
+		if d != domain && rm.domainFunc(domain, d) {
+			domains = append(domains, d)
+		}
+	}
+	c.matching[domain] = domains
+	return domains, nil
+}
+
+// Clear removes all stored links, users and roles. With OpScope only links of adapter scope
+// are removed while users and roles are kept as they may be shared with other scopes.
+func (rm *roleManager) Clear() error {
+	if rm.shared {
+		return nil
+	}
+	err := rm.adapter.clearCollection(context.Background(), rm.edges)
+	if err != nil || len(rm.adapter.scope) > 0 {
+		return err
+	}
+	return rm.vertices.Truncate(context.Background())
+}
+
+// AddLink adds link meaning that name1 inherits role name2. Adding existing link is not an error.
+func (rm *roleManager) AddLink(name1 string, name2 string, domain ...string) error {
+	if rm.shared {
+		return nil
+	}
+	edge := map[string]interface{}{
+		"_key":          rm.linkKey(name1, name2, domain...),
+		"_from":         rm.vertexID(name1),
+		"_to":           rm.vertexID(name2),
+		rm.ptypeField(): rm.ptype,
+	}
+	rm.adapter.stampScope(edge)
+	if len(domain) > 1 {
+		return ErrTooManyArguments
+	}
+	if len(domain) == 1 {
+		field, err := rm.domainField()
+		if err != nil {
+			return err
+		}
+		edge[field] = domain[0]
+	}
+	ctx := arango.WithOverwriteMode(context.Background(), arango.OverwriteModeIgnore)
+	_, _, err := rm.vertices.CreateDocuments(ctx, []map[string]interface{}{
+		{"_key": vertexKey(name1), nameField: name1},
+		{"_key": vertexKey(name2), nameField: name2},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = rm.edges.CreateDocument(ctx, edge)
+	return err
+}
+
+// BuildRelationship is deprecated part of rbac.RoleManager and does nothing.
+func (rm *roleManager) BuildRelationship(name1 string, name2 string, domain ...string) error {
+	return nil
+}
+
+// DeleteLink removes link between name1 and role name2. Removing missing link is not an error.
+func (rm *roleManager) DeleteLink(name1 string, name2 string, domain ...string) error {
+	if rm.shared {
+		return nil
+	}
+	_, err := rm.edges.RemoveDocument(context.Background(), rm.linkKey(name1, name2, domain...))
+	if arango.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// HasLink determines whether name1 inherits role name2, directly or through at most maximal
+// depth of intermediate roles. With domain all links on the way must belong to it. Traversal is
+// pruned at links that do not apply, so only the last link of every path needs to be checked;
+// vertices are unique per path as the same role may be reached first over link that does not
+// apply and later over one that does. Prune condition is evaluated for start vertex too, where
+// there is no edge yet, so it is guarded to never stop traversal there.
+func (rm *roleManager) HasLink(name1 string, name2 string, domain ...string) (bool, error) {
+	if name1 == name2 || (rm.matchingFunc != nil && rm.Match(name1, name2)) {
+		return true, nil
+	}
+	bindings := map[string]interface{}{
+		"depth":  rm.maxDepth,
+		"start":  rm.vertexID(name1),
+		"target": rm.vertexID(name2),
+	}
+	filter, err := rm.edgeFilter("e", bindings, domain)
+	if err != nil {
+		return false, err
+	}
+	query := fmt.Sprintf(`FOR v, e IN 1..@depth OUTBOUND @start %s
+		PRUNE e != null && (v._id == @target || !(%s))
+		OPTIONS {order: "bfs", uniqueVertices: "path"}
+		FILTER v._id == @target && %s LIMIT 1 RETURN true`,
+		rm.edgesName, filter, filter)
+	names, err := rm.names(query, bindings)
+	if err != nil {
+		return false, err
+	}
+	return len(names) > 0, nil
+}
+
+// GetRoles returns roles directly inherited by name.
+func (rm *roleManager) GetRoles(name string, domain ...string) ([]string, error) {
+	return rm.neighbours("OUTBOUND", name, domain)
+}
+
+// GetUsers returns users (or roles) directly inheriting role name.
+func (rm *roleManager) GetUsers(name string, domain ...string) ([]string, error) {
+	return rm.neighbours("INBOUND", name, domain)
+}
+
+func (rm *roleManager) neighbours(direction string, name string, domain []string) ([]string, error) {
+	bindings := map[string]interface{}{
+		"start": rm.vertexID(name),
+	}
+	filter, err := rm.edgeFilter("e", bindings, domain)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`FOR v, e IN 1..1 %s @start %s FILTER %s && v != null RETURN DISTINCT v.%s`,
+		direction, rm.edgesName, filter, nameField)
+	return rm.names(query, bindings)
+}
+
+// names runs query returning list of values and collects them as strings; true is returned as "true".
+func (rm *roleManager) names(query string, bindings map[string]interface{}) ([]string, error) {
+	cursor, err := rm.adapter.database.Query(context.Background(), query, bindings)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	names := []string{}
+	for cursor.HasMore() {
+		var v interface{}
+		_, err := cursor.ReadDocument(context.Background(), &v)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, fmt.Sprint(v))
+	}
+	return names, nil
+}
+
+// GetDomains returns domains in which name has any role.
+func (rm *roleManager) GetDomains(name string) ([]string, error) {
+	return rm.domains("FILTER e._from == @start", map[string]interface{}{
+		"start": rm.vertexID(name),
+	})
+}
+
+// GetAllDomains returns all domains of stored links.
+func (rm *roleManager) GetAllDomains() ([]string, error) {
+	return rm.domains("", map[string]interface{}{})
+}
+
+func (rm *roleManager) domains(filter string, bindings map[string]interface{}) ([]string, error) {
+	field, err := rm.domainField()
+	if err != nil {
+		return []string{}, nil
+	}
+	cond, err := rm.edgeFilter("e", bindings, nil)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`FOR e IN %s FILTER %s && e.%s != null %s RETURN DISTINCT e.%s`,
+		rm.edgesName, cond, field, filter, field)
+	return rm.names(query, bindings)
+}
+
+// PrintRoles logs all stored links with configured logger.
+func (rm *roleManager) PrintRoles() error {
+	if !rm.logger.IsEnabled() {
+		return nil
+	}
+	bindings := map[string]interface{}{}
+	cond, err := rm.edgeFilter("e", bindings, nil)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`FOR e IN %s FILTER %s
+		LET user = DOCUMENT(e._from).%s
+		COLLECT name = user INTO roles = DOCUMENT(e._to).%s
+		RETURN CONCAT(name, " < ", CONCAT_SEPARATOR(", ", roles))`,
+		rm.edgesName, cond, nameField, nameField)
+	lines, err := rm.names(query, bindings)
+	if err != nil {
+		return err
+	}
+	sort.Strings(lines)
+	rm.logger.LogRole(lines)
+	return nil
+}
+
+// SetLogger sets role manager's logger.
+func (rm *roleManager) SetLogger(logger log.Logger) {
+	rm.logger = logger
+}
+
+// Match matches name against pattern using matching function added with AddMatchingFunc.
+// Note that stored links are always traversed by exact names; matching function is only
+// consulted when comparing both names given to HasLink.
+func (rm *roleManager) Match(str string, pattern string) bool {
+	if rm.matchingFunc == nil {
+		return str == pattern
+	}
+	return rm.matchingFunc(str, pattern)
+}
+
+// AddMatchingFunc adds function used by Match.
+func (rm *roleManager) AddMatchingFunc(name string, fn rbac.MatchingFunc) {
+	rm.matchingFunc = fn
+}
+
+// AddDomainMatchingFunc adds function deciding whether links of stored domain (second argument)
+// apply to domain of query (first argument), e.g. util.KeyMatch for wildcard domains.
+func (rm *roleManager) AddDomainMatchingFunc(name string, fn rbac.MatchingFunc) {
+	rm.domainCache.lock.Lock()
+	rm.domainCache.all = nil
+	rm.domainCache.lock.Unlock()
+	rm.domainFunc = fn
+}
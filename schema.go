@@ -0,0 +1,120 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"fmt"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+// SchemaViolation describes single policy document that does not conform to adapter schema.
+type SchemaViolation struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+// schemaRule builds JSON schema matching documents written by adapter: ptype is required
+// non empty string, remaining mapped fields are optional strings, arity (if enabled) is
+// an integer within mapping bounds, section is a non empty string and no other attributes
+// are allowed. Scope attributes are required strings. With change tracking or soft delete
+// tombstones are accepted in place of ptype. System attributes (_key, _id, _rev) are never
+// validated by ArangoDB.
+func (a *adapter) schemaRule() map[string]interface{} {
+	properties := make(map[string]interface{}, len(a.mapping)+2)
+	properties[a.mapping[0]] = map[string]interface{}{"type": "string", "minLength": 1}
+	for _, name := range a.mapping[1:] {
+		properties[name] = map[string]interface{}{"type": "string"}
+	}
+	if a.arityField != "" {
+		properties[a.arityField] = map[string]interface{}{"type": "integer", "minimum": 1, "maximum": len(a.mapping) - 1}
+	}
+	if a.sectionField != "" {
+		properties[a.sectionField] = map[string]interface{}{"type": "string", "minLength": 1}
+	}
+	// schema is shared by all scopes stored in collection so values are not checked
+	for _, name := range a.scopeFields() {
+		properties[name] = map[string]interface{}{"type": "string"}
+	}
+	if a.metadataOn {
+		properties[metadataField] = map[string]interface{}{"type": "object"}
+	}
+	rule := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             append(a.scopeFields(), a.mapping[0]),
+		"additionalProperties": false,
+	}
+	if a.expiring() {
+		properties[expireAtField] = map[string]interface{}{"type": "string"}
+	}
+	if a.validity {
+		properties[validFromField] = map[string]interface{}{"type": "string"}
+		properties[validUntilField] = map[string]interface{}{"type": "string"}
+	}
+	if a.tombstones() {
+		properties[updatedAtField] = map[string]interface{}{"type": "integer"}
+		properties[deletedAtField] = map[string]interface{}{"type": "string"}
+		properties[a.tombstoneField()] = map[string]interface{}{"type": "string", "minLength": 1}
+		delete(rule, "required")
+		rule["anyOf"] = []interface{}{
+			map[string]interface{}{"required": append(a.scopeFields(), a.mapping[0])},
+			map[string]interface{}{"required": append(a.scopeFields(), deletedAtField, a.tombstoneField())},
+		}
+	}
+	return rule
+}
+
+func (a *adapter) schema() *arango.CollectionSchemaOptions {
+	return &arango.CollectionSchemaOptions{
+		Rule:    a.schemaRule(),
+		Level:   a.schemaLevel,
+		Message: fmt.Sprintf("document does not match casbin policy schema of collection %s", a.collectionName),
+	}
+}
+
+// VerifySchema checks all documents in policy collection against schema derived from field mapping.
+// It works regardless of OpSchemaValidation being set, so may be used to find documents inserted
+// before schema was installed.
+func (a *adapter) VerifySchema() ([]SchemaViolation, error) {
+	if err := a.ensureReady(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`FOR d IN %s FILTER %s
+		LET v = SCHEMA_VALIDATE(UNSET(d, "_key", "_id", "_rev"), @schema)
+		FILTER !v.valid
+		RETURN {"key": d._key, "message": v.errorMessage}`, a.collectionName, a.scopeFilter("d"))
+	cursor, err := a.database.Query(context.Background(), query, map[string]interface{}{
+		"schema": a.schemaRule(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	violations := []SchemaViolation{}
+	for {
+		var v SchemaViolation
+		_, err := cursor.ReadDocument(context.Background(), &v)
+		if arango.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		violations = append(violations, v)
+	}
+	return violations, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+// scopeFields returns names of scope attributes in stable order.
+func (a *adapter) scopeFields() []string {
+	fields := make([]string, 0, len(a.scope))
+	for name := range a.scope {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// scopeValues returns values of scope attributes in order of scopeFields.
+func (a *adapter) scopeValues() []string {
+	values := make([]string, 0, len(a.scope))
+	for _, name := range a.scopeFields() {
+		values = append(values, a.scope[name])
+	}
+	return values
+}
+
+// scopeFilter returns AQL condition matching documents of adapter scope bound to variable v.
+// Values are embedded in query as literals so condition may be part of prepared query templates.
+func (a *adapter) scopeFilter(v string) string {
+	if len(a.scope) == 0 {
+		return "true"
+	}
+	comp := make([]string, 0, len(a.scope))
+	for _, name := range a.scopeFields() {
+		comp = append(comp, fmt.Sprintf("%s[%s] == %s", v, aqlString(name), aqlString(a.scope[name])))
+	}
+	return strings.Join(comp, " && ")
+}
+
+// aqlString returns s as AQL string literal; JSON string escaping is valid in AQL.
+func aqlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// stampScope sets scope attributes of document.
+func (a *adapter) stampScope(doc map[string]interface{}) {
+	for name, value := range a.scope {
+		doc[name] = value
+	}
+}
+
+// indexFields returns fields of unique index: mapping prefixed with scope attributes so the same
+// rule may be stored once per scope.
+func (a *adapter) indexFields() []string {
+	return append(a.scopeFields(), a.mapping...)
+}
+
+// checkScopedIndexes fails with ErrUnscopedIndex if scoped adapter finds unique index that does
+// not cover all scope attributes, e.g. one left by adapter used before scope was introduced.
+func (a *adapter) checkScopedIndexes(col arango.Collection) error {
+	if len(a.scope) == 0 {
+		return nil
+	}
+	indexes, err := col.Indexes(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if !index.Unique() || index.Type() == arango.PrimaryIndex || index.Type() == arango.EdgeIndex {
+			continue
+		}
+		fields := make(map[string]bool, len(index.Fields()))
+		for _, field := range index.Fields() {
+			fields[field] = true
+		}
+		for name := range a.scope {
+			if !fields[name] {
+				return fmt.Errorf("%w: %s on %s", ErrUnscopedIndex, index.Name(), strings.Join(index.Fields(), ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// clearCollection removes all documents of adapter scope from collection. Unscoped adapter
+// truncates it.
+func (a *adapter) clearCollection(ctx context.Context, col arango.Collection) error {
+	if len(a.scope) == 0 {
+		return col.Truncate(ctx)
+	}
+	return a.execute(ctx, fmt.Sprintf("FOR d IN %s FILTER %s REMOVE d IN %s", col.Name(), a.scopeFilter("d"), col.Name()), nil)
+}
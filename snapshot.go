@@ -0,0 +1,136 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+)
+
+// snapshotRule is a single rule as stored in local snapshot file.
+type snapshotRule struct {
+	Sec        string     `json:"sec"`
+	PType      string     `json:"ptype"`
+	Rule       []string   `json:"rule"`
+	ValidFrom  *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+}
+
+type snapshotFile struct {
+	Rules []snapshotRule `json:"rules"`
+}
+
+// ensureReady sets up database structures if it has not been done yet, i.e. when adapter has been
+// created while database was unavailable.
+func (a *adapter) ensureReady() error {
+	a.initLock.Lock()
+	defer a.initLock.Unlock()
+	if a.collection != nil {
+		return nil
+	}
+	return a.initialize()
+}
+
+func (a *adapter) setDegraded(degraded bool) {
+	a.stateLock.Lock()
+	a.degraded = degraded
+	a.stateLock.Unlock()
+}
+
+// Degraded reports whether policy has been loaded from local snapshot instead of database.
+func (a *adapter) Degraded() bool {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	return a.degraded
+}
+
+// writeSnapshot stores all rules of model (or only ones of ptype of collection when adapter is
+// part of collection per ptype setup) in snapshot file. File is replaced atomically so readers
+// never see partially written snapshot.
+func (a *adapter) writeSnapshot(model model.Model) error {
+	var validity map[string]interface{}
+	if a.validity {
+		var err error
+		if validity, err = a.storedValidity(context.Background()); err != nil {
+			return err
+		}
+	}
+	snapshot := snapshotFile{Rules: []snapshotRule{}}
+	for sec, assertions := range model {
+		for ptype, ast := range assertions {
+			if a.ptype != "" && ptype != a.ptype {
+				continue
+			}
+			rules := make([]PolicyRule, 0, len(ast.Policy))
+			for _, rule := range ast.Policy {
+				rules = append(rules, PolicyRule{Sec: sec, PType: ptype, Rule: rule})
+			}
+			for _, r := range withValidity(rules, validity) {
+				snapshot.Rules = append(snapshot.Rules, snapshotRule(r))
+			}
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(a.snapshotPath), filepath.Base(a.snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), a.snapshotPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// loadSnapshot adds rules stored in snapshot file and valid now to model.
+func (a *adapter) loadSnapshot(model model.Model) error {
+	data, err := os.ReadFile(a.snapshotPath)
+	if err != nil {
+		return err
+	}
+	var snapshot snapshotFile
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, r := range snapshot.Rules {
+		if r.ValidFrom != nil && r.ValidFrom.After(now) || r.ValidUntil != nil && !r.ValidUntil.After(now) {
+			continue
+		}
+		line := policyLine{sec: r.Sec, ptype: r.PType, rule: r.Rule}
+		if err := a.applyPolicyLine(model, "", line, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+var ErrSoftDeleteOff error = errors.New("soft delete is not enabled")
+
+// expireAtField is a name of attribute with ISO 8601 time document is purged at by TTL index.
+const expireAtField = "ExpireAt"
+
+// tombstones reports whether removed rules are kept as tombstones instead of being deleted.
+func (a *adapter) tombstones() bool {
+	return a.tracking || a.softDelete
+}
+
+// expiring reports whether documents may get ExpireAt attribute and be purged by TTL index:
+// tombstones with retention or rules with validity TTL.
+func (a *adapter) expiring() bool {
+	return a.tombstones() && a.retention > 0 || a.validityTTL
+}
+
+// UndeletePolicy brings back most recently removed rule if its tombstone is still within
+// retention period. ErrPolicyNotFound is returned if there is no such tombstone.
+func (a *adapter) UndeletePolicy(sec string, ptype string, rule []string) error {
+	return wrapError(AddOperation, ptype, rule, a.undeletePolicy(sec, ptype, rule))
+}
+
+func (a *adapter) undeletePolicy(sec string, ptype string, rule []string) error {
+	if !a.softDelete {
+		return ErrSoftDeleteOff
+	}
+	if 1+len(rule) > len(a.mapping) {
+		return ErrTooManyArguments
+	}
+	if err := a.ensureReady(); err != nil {
+		return err
+	}
+	filter, bindings := a.ruleFilterOn(a.tombstoneField(), sec, ptype, rule)
+	if a.retention > 0 {
+		// TTL index purges expired tombstones periodically so they may still be around
+		filter = fmt.Sprintf("%s && DATE_TIMESTAMP(d.%s) >= DATE_NOW() - %d",
+			filter, deletedAtField, a.retention.Milliseconds())
+	}
+	// rule is purged when its validity ends (see OpValidity) as it was before removal
+	expire := "null"
+	if a.validityTTL {
+		expire = "d." + validUntilField
+	}
+	query := fmt.Sprintf(`FOR d IN %s FILTER %s && d.%s != null && %s SORT d.%s DESC LIMIT 1
+		UPDATE d WITH {%s: d.%s, %s: null, %s: null, %s: %s, %s: DATE_NOW()} IN %s OPTIONS {keepNull: false}
+		RETURN 1`,
+		a.collectionName, a.scopeFilter("d"), deletedAtField, filter, deletedAtField,
+		a.mapping[0], a.tombstoneField(), a.tombstoneField(), deletedAtField, expireAtField, expire, updatedAtField,
+		a.collectionName)
+	return a.transaction(context.Background(), func(ctx context.Context) error {
+		cursor, err := a.database.Query(ctx, query, bindings)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		var one int
+		_, err = cursor.ReadDocument(ctx, &one)
+		if arango.IsNoMoreDocuments(err) {
+			return ErrPolicyNotFound
+		} else if err != nil {
+			return err
+		}
+		return a.auditChange(ctx, AddOperation, nil, []PolicyRule{{Sec: sec, PType: ptype, Rule: rule}})
+	})
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"fmt"
+
+	arango "github.com/arangodb/go-driver"
+	"github.com/casbin/casbin/v2/model"
+)
+
+const (
+	updatedAtField = "UpdatedAt"
+	deletedAtField = "DeletedAt"
+)
+
+// syncOverlap is how far (in milliseconds) SyncPolicy looks back before previous synchronization.
+// It covers writes that took their timestamp before synchronization but were committed after it.
+// Changes are applied idempotently so reading some of them twice is harmless.
+const syncOverlap = 10000
+
+// tombstoneField is a name of attribute keeping ptype of removed rule. Ptype attribute itself is
+// removed from tombstone so it is skipped by sparse unique index and by all removal filters.
+func (a *adapter) tombstoneField() string {
+	return "Deleted" + a.mapping[0]
+}
+
+// tombstoneAction is an AQL operation turning document d into tombstone. With tombstone
+// retention tombstone also gets time it is purged at; otherwise purge time of rule validity
+// (see OpValidity) is dropped so tombstone is kept forever.
+func (a *adapter) tombstoneAction() string {
+	expire := ""
+	if a.retention > 0 {
+		expire = fmt.Sprintf(", %s: DATE_ISO8601(DATE_NOW() + %d)", expireAtField, a.retention.Milliseconds())
+	} else if a.validityTTL {
+		expire = fmt.Sprintf(", %s: null", expireAtField)
+	}
+	return fmt.Sprintf("UPDATE d WITH {%s: null, %s: d.%s, %s: DATE_ISO8601(DATE_NOW()), %s: DATE_NOW()%s} IN %s OPTIONS {keepNull: false}",
+		a.mapping[0], a.tombstoneField(), a.mapping[0], deletedAtField, updatedAtField, expire, a.collectionName)
+}
+
+// serverTime returns current database time in milliseconds. Database time is used instead of
+// local one so clocks of different adapter instances do not need to be synchronized.
+func (a *adapter) serverTime() (int64, error) {
+	cursor, err := a.database.Query(context.Background(), "RETURN DATE_NOW()", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var now int64
+	_, err = cursor.ReadDocument(context.Background(), &now)
+	return now, err
+}
+
+// execute runs data modification query discarding its result.
+func (a *adapter) execute(ctx context.Context, query string, bindings map[string]interface{}) error {
+	cursor, err := a.database.Query(ctx, query, bindings)
+	if err != nil {
+		return err
+	}
+	return cursor.Close()
+}
+
+// insertTracked writes documents stamped with database time and returns number of documents
+// actually inserted (ones with existing keys are skipped in overwrite mode ignore). Tombstones
+// occupying keys of inserted documents (see OpDeterministicKeys) are purged first; readers will
+// learn about rule being present again from the inserted document.
+func (a *adapter) insertTracked(ctx context.Context, docs []interface{}) (int, error) {
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	if a.stableKeys {
+		keys := make([]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			keys = append(keys, doc.(map[string]interface{})["_key"])
+		}
+		err := a.execute(ctx, fmt.Sprintf("FOR d IN %s FILTER d._key IN @keys && d.%s != null REMOVE d IN %s",
+			a.collectionName, deletedAtField, a.collectionName), map[string]interface{}{"keys": keys})
+		if err != nil {
+			return 0, err
+		}
+	}
+	query := fmt.Sprintf(`LET inserted = (FOR doc IN @docs INSERT MERGE(doc, {%s: DATE_NOW()}) INTO %s OPTIONS {overwriteMode: %q} RETURN NEW != null)
+		RETURN LENGTH(inserted[* FILTER CURRENT])`,
+		updatedAtField, a.collectionName, a.overwriteMode)
+	cursor, err := a.database.Query(ctx, query, map[string]interface{}{"docs": docs})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var n int
+	_, err = cursor.ReadDocument(ctx, &n)
+	return n, err
+}
+
+// savePolicyTracked replaces stored policy with lines touching only documents that differ:
+// rules no longer present become tombstones and new rules are inserted with given validity. Documents that do not
+// form valid rule are removed as SavePolicy without tracking would do.
+func (a *adapter) savePolicyTracked(ctx context.Context, lines []policyLine, validity map[string]interface{}) error {
+	live := make(map[string][]string)
+	invalid := []string{}
+	err := a.readPolicy(ctx, a.query, nil, func(key string, line policyLine, err error) error {
+		if err != nil {
+			invalid = append(invalid, key)
+			return nil
+		}
+		pk := policyKey(line.sec, line.ptype, line.rule)
+		live[pk] = append(live[pk], key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	added := []policyLine{}
+	for _, l := range lines {
+		pk := policyKey(l.sec, l.ptype, l.rule)
+		if keys := live[pk]; len(keys) > 0 {
+			live[pk] = keys[1:]
+			continue
+		}
+		added = append(added, l)
+	}
+	docs, err := a.policyDocuments(added)
+	if err != nil {
+		return err
+	}
+	if a.metadataOn {
+		a.attachMetadata(added, docs, nil)
+	}
+	if a.validity {
+		attachValidity(added, docs, validity)
+	}
+	removed := []string{}
+	for _, keys := range live {
+		removed = append(removed, keys...)
+	}
+
+	if len(invalid) > 0 {
+		err = a.execute(ctx, fmt.Sprintf("FOR d IN %s FILTER d._key IN @keys REMOVE d IN %s", a.collectionName, a.collectionName),
+			map[string]interface{}{"keys": invalid})
+		if err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		err = a.execute(ctx, fmt.Sprintf("FOR d IN %s FILTER d._key IN @keys %s", a.collectionName, a.tombstoneAction()),
+			map[string]interface{}{"keys": removed})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = a.insertTracked(ctx, docs)
+	return err
+}
+
+// SyncPolicy applies to model changes done in database since previous LoadPolicy or SyncPolicy
+// call: rules added in the meantime are added to model and removed ones are removed from it.
+// If policy has not been loaded yet, previous synchronization is older than tombstone retention
+// (so tombstones of some removals may have been purged already) or validity window of any rule
+// has begun or ended since (which does not modify any document), policy of model is replaced with
+// one loaded in full; model is left intact if that fails. Role links of enforcer using model must be rebuilt by caller afterwards.
+func (a *adapter) SyncPolicy(model model.Model) error {
+	if !a.tracking {
+		return wrapError(LoadOperation, "", nil, ErrChangeTrackingOff)
+	}
+	a.stateLock.Lock()
+	since, boundary := a.syncedAt, a.boundary
+	a.stateLock.Unlock()
+	if since == 0 {
+		return a.LoadPolicy(model)
+	}
+	if err := a.ensureReady(); err != nil {
+		return wrapError(LoadOperation, "", nil, err)
+	}
+
+	now, err := a.serverTime()
+	if err != nil {
+		return wrapError(LoadOperation, "", nil, err)
+	}
+	if a.retention > 0 && now-since+syncOverlap >= a.retention.Milliseconds() || boundary > 0 && now >= boundary {
+		return reloadPolicy(model, a.ptype, a.LoadPolicy)
+	}
+	if a.validity {
+		// rules synchronized now may bring boundaries earlier than the one of last load
+		boundary, err = a.nextBoundary(context.Background())
+		if err != nil {
+			return wrapError(LoadOperation, "", nil, err)
+		}
+	}
+	err = a.syncPolicy(model, since-syncOverlap)
+	if err != nil {
+		return wrapError(LoadOperation, "", nil, err)
+	}
+	a.stateLock.Lock()
+	a.syncedAt = now
+	a.boundary = boundary
+	a.stateLock.Unlock()
+	return nil
+}
+
+func (a *adapter) syncPolicy(model model.Model, since int64) error {
+	// rules outside of their validity window are applied as removed
+	removed := fmt.Sprintf("d.%s != null", deletedAtField)
+	if a.validity {
+		removed = fmt.Sprintf("%s || !(%s)", removed, a.validityFilter("d"))
+	}
+	// tombstones are sorted before documents with the same timestamp: rule removed and added
+	// again within the same millisecond is more likely than the other way round
+	query := fmt.Sprintf(`FOR d IN %s FILTER %s && d.%s >= @since SORT d.%s, d.%s == null
+		LET e = d.%s == null ? d : MERGE(d, {%s: d.%s})
+		RETURN APPEND(%s, [%s])`,
+		a.collectionName, a.scopeFilter("d"), updatedAtField, updatedAtField, deletedAtField,
+		deletedAtField, a.mapping[0], a.tombstoneField(),
+		a.projection("e"), removed)
+	ctx := a.queryContext(context.Background())
+	cursor, err := a.database.Query(ctx, query, map[string]interface{}{"since": since})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var row []interface{}
+	for {
+		_, err := cursor.ReadDocument(ctx, &row)
+		if arango.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		key, _ := row[0].(string)
+		deleted, _ := row[len(row)-1].(bool)
+		line, err := a.decodePolicyLine(row[:len(row)-1])
+		if deleted && err == nil {
+			if _, ok := model[line.sec][line.ptype]; ok {
+				model.RemovePolicy(line.sec, line.ptype, line.rule)
+			}
+			continue
+		}
+		if err = a.applyPolicyLine(model, key, line, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrValidityOff error = errors.New("rule validity is not enabled")
+
+const (
+	validFromField  = "ValidFrom"
+	validUntilField = "ValidUntil"
+	// isoTimeLayout is ISO 8601 format understood by AQL date functions and TTL index; strings
+	// in this format compare the same way as times they represent
+	isoTimeLayout = "2006-01-02T15:04:05.000Z"
+)
+
+// isoTime formats time as stored in validity attributes.
+func isoTime(t time.Time) string {
+	return t.UTC().Format(isoTimeLayout)
+}
+
+// validityFilter is an AQL condition true for document v holding rule that is valid now.
+func (a *adapter) validityFilter(v string) string {
+	return fmt.Sprintf("(%s.%s == null || DATE_TIMESTAMP(%s.%s) <= DATE_NOW()) && (%s.%s == null || DATE_TIMESTAMP(%s.%s) > DATE_NOW())",
+		v, validFromField, v, validFromField, v, validUntilField, v, validUntilField)
+}
+
+// pendingFilter is an AQL condition true for document v holding rule that is not valid yet.
+func (a *adapter) pendingFilter(v string) string {
+	return fmt.Sprintf("%s.%s != null && DATE_TIMESTAMP(%s.%s) > DATE_NOW()", v, validFromField, v, validFromField)
+}
+
+// retireExpired removes (or turns into tombstones) stored rules whose validity has ended, so they
+// do not block adding the same rule again. Must be called within transaction of the change.
+func (a *adapter) retireExpired(ctx context.Context) error {
+	return a.execute(ctx, fmt.Sprintf("FOR d IN %s FILTER d.%s != null && d.%s <= DATE_ISO8601(DATE_NOW()) && %s %s",
+		a.collectionName, validUntilField, validUntilField, a.liveFilter, a.removeAction), nil)
+}
+
+// nextBoundary returns database time (in milliseconds) at which validity window of any stored rule
+// begins or ends next; zero if there is no such moment.
+func (a *adapter) nextBoundary(ctx context.Context) (int64, error) {
+	query := fmt.Sprintf(`LET now = DATE_ISO8601(DATE_NOW())
+		LET next = MIN(FOR d IN %s FILTER %s && (d.%s > now || d.%s > now)
+			RETURN MIN([d.%s > now ? d.%s : null, d.%s > now ? d.%s : null]))
+		RETURN next == null ? 0 : DATE_TIMESTAMP(next)`,
+		a.collectionName, a.liveFilter, validFromField, validUntilField,
+		validFromField, validFromField, validUntilField, validUntilField)
+	cursor, err := a.database.Query(ctx, query, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var boundary int64
+	_, err = cursor.ReadDocument(ctx, &boundary)
+	return boundary, err
+}
+
+// storedValidity returns validity attributes of stored rules that are valid now, keyed by policyKey.
+func (a *adapter) storedValidity(ctx context.Context) (map[string]interface{}, error) {
+	return a.storedValues(ctx,
+		fmt.Sprintf("(d.%s != null || d.%s != null) && %s", validFromField, validUntilField, a.validityFilter("d")),
+		fmt.Sprintf("KEEP(d, %q, %q, %q)", validFromField, validUntilField, expireAtField))
+}
+
+// parseISOTime returns time stored in validity attribute; nil if there is none.
+func parseISOTime(value interface{}) *time.Time {
+	s, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// withValidity sets validity windows of rules to ones stored (see storedValidity).
+func withValidity(rules []PolicyRule, stored map[string]interface{}) []PolicyRule {
+	for i, r := range rules {
+		attrs, ok := stored[policyKey(r.Sec, r.PType, r.Rule)].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rules[i].ValidFrom = parseISOTime(attrs[validFromField])
+		rules[i].ValidUntil = parseISOTime(attrs[validUntilField])
+	}
+	return rules
+}
+
+// validityAttributes returns attributes of document storing rule valid between given times, zero
+// time meaning no bound.
+func (a *adapter) validityAttributes(validFrom time.Time, validUntil time.Time) map[string]interface{} {
+	attrs := make(map[string]interface{}, 3)
+	if !validFrom.IsZero() {
+		attrs[validFromField] = isoTime(validFrom)
+	}
+	if !validUntil.IsZero() {
+		attrs[validUntilField] = isoTime(validUntil)
+		if a.validityTTL {
+			attrs[expireAtField] = isoTime(validUntil)
+		}
+	}
+	return attrs
+}
+
+// rulesValidity returns validity attributes of bounded rules keyed by policyKey, in the form
+// returned by storedValidity.
+func (a *adapter) rulesValidity(rules []PolicyRule) map[string]interface{} {
+	validity := make(map[string]interface{})
+	for _, r := range rules {
+		var validFrom, validUntil time.Time
+		if r.ValidFrom != nil {
+			validFrom = *r.ValidFrom
+		}
+		if r.ValidUntil != nil {
+			validUntil = *r.ValidUntil
+		}
+		if attrs := a.validityAttributes(validFrom, validUntil); len(attrs) > 0 {
+			validity[policyKey(r.Sec, r.PType, r.Rule)] = attrs
+		}
+	}
+	return validity
+}
+
+// attachValidity sets validity attributes of documents being saved to ones of the same rule in
+// stored (see storedValidity).
+func attachValidity(lines []policyLine, docs []interface{}, stored map[string]interface{}) {
+	for i, l := range lines {
+		attrs, ok := stored[policyKey(l.sec, l.ptype, l.rule)].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		doc := docs[i].(map[string]interface{})
+		for name, value := range attrs {
+			doc[name] = value
+		}
+	}
+}
+
+// AddPolicyWithExpiry works as AddPolicy; added rule is valid until given time.
+func (a *adapter) AddPolicyWithExpiry(sec string, ptype string, rule []string, validUntil time.Time) error {
+	return a.AddPolicyWithValidity(sec, ptype, rule, time.Time{}, validUntil)
+}
+
+// AddPolicyWithValidity works as AddPolicy; added rule is valid between given times, zero time
+// meaning no bound. With TTL (see OpValidity) rule is purged from database after it expires.
+func (a *adapter) AddPolicyWithValidity(sec string, ptype string, rule []string, validFrom time.Time, validUntil time.Time) error {
+	if !a.validity {
+		return wrapError(AddOperation, ptype, rule, ErrValidityOff)
+	}
+	return a.addPolicy(context.Background(), sec, ptype, rule, a.validityAttributes(validFrom, validUntil))
+}
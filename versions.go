@@ -0,0 +1,236 @@
+// Copyright 2019 Adam Wasila
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arangodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+var (
+	ErrVersioningOff   error = errors.New("policy versioning is not enabled")
+	ErrVersionNotFound error = errors.New("policy version not found")
+)
+
+const (
+	versionNumberField = "number"
+	versionRulesField  = "rules"
+)
+
+// Version is a numbered snapshot of all rules stored by adapter.
+type Version struct {
+	// Number identifies version; numbers of consecutive versions are increasing
+	Number int `json:"number"`
+	// Time is a moment version has been recorded
+	Time time.Time `json:"time"`
+	// Actor identifies author of the change that created version
+	Actor string `json:"actor,omitempty"`
+	// Size is a number of rules of version
+	Size int `json:"size"`
+	// Rules are rules of version; not returned by Versions
+	Rules []PolicyRule `json:"rules,omitempty"`
+}
+
+// initializeVersions prepares collection of policy versions. Unique index makes concurrent saves
+// that try to record version with the same number fail instead of overwriting each other.
+func (a *adapter) initializeVersions() error {
+	versions, err := a.ensureCollection(a.versionsName, nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = versions.EnsurePersistentIndex(context.Background(),
+		append(a.scopeFields(), versionNumberField), &arango.EnsurePersistentIndexOptions{
+			Unique: true,
+		})
+	if err != nil {
+		return err
+	}
+	a.versions = versions
+	return nil
+}
+
+// recordVersions records saved rules as new version. If stored rules differ from newest version
+// (e.g. have been changed by AddPolicy since) they are recorded first so they may be restored
+// later. Must be called within transaction of the change.
+func (a *adapter) recordVersions(ctx context.Context, stored []PolicyRule, saved []PolicyRule) error {
+	latest, err := a.latestVersion(ctx)
+	if err != nil && !errors.Is(err, ErrVersionNotFound) {
+		return err
+	}
+	number, recorded := 1, []PolicyRule(nil)
+	if latest != nil {
+		number, recorded = latest.Number+1, latest.Rules
+	}
+	if !sameRules(recorded, stored) {
+		if err = a.insertVersion(ctx, number, stored); err != nil {
+			return err
+		}
+		number++
+	} else if latest != nil && sameRules(stored, saved) {
+		return nil
+	}
+	return a.insertVersion(ctx, number, saved)
+}
+
+// sameRules reports whether both lists hold the same rules regardless of order.
+func sameRules(a []PolicyRule, b []PolicyRule) bool {
+	removed, added := diffRules(a, b)
+	return len(removed) == 0 && len(added) == 0
+}
+
+func (a *adapter) insertVersion(ctx context.Context, number int, rules []PolicyRule) error {
+	doc := map[string]interface{}{
+		versionNumberField: number,
+		"time":             time.Now().UTC(),
+		"size":             len(rules),
+		versionRulesField:  rules,
+	}
+	if actor := a.actor(ctx); actor != "" {
+		doc["actor"] = actor
+	}
+	a.stampScope(doc)
+	_, err := a.versions.CreateDocument(ctx, doc)
+	return err
+}
+
+// version returns version with given number.
+func (a *adapter) version(ctx context.Context, number int) (*Version, error) {
+	query := fmt.Sprintf("FOR v IN %s FILTER %s && v.%s == @number LIMIT 1 RETURN v",
+		a.versionsName, a.scopeFilter("v"), versionNumberField)
+	return a.readVersion(ctx, query, map[string]interface{}{"number": number})
+}
+
+// latestVersion returns version with the highest number.
+func (a *adapter) latestVersion(ctx context.Context) (*Version, error) {
+	query := fmt.Sprintf("FOR v IN %s FILTER %s SORT v.%s DESC LIMIT 1 RETURN v",
+		a.versionsName, a.scopeFilter("v"), versionNumberField)
+	return a.readVersion(ctx, query, nil)
+}
+
+func (a *adapter) readVersion(ctx context.Context, query string, bindings map[string]interface{}) (*Version, error) {
+	cursor, err := a.database.Query(ctx, query, bindings)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var v Version
+	_, err = cursor.ReadDocument(ctx, &v)
+	if arango.IsNoMoreDocuments(err) {
+		return nil, ErrVersionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Versions lists stored policy versions, oldest first; rules of versions are not returned.
+func (a *adapter) Versions() ([]Version, error) {
+	versions, err := a.listVersions()
+	return versions, wrapError(LoadOperation, "", nil, err)
+}
+
+func (a *adapter) listVersions() ([]Version, error) {
+	if a.versionsName == "" {
+		return nil, ErrVersioningOff
+	}
+	if err := a.ensureReady(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("FOR v IN %s FILTER %s SORT v.%s RETURN UNSET(v, %q)",
+		a.versionsName, a.scopeFilter("v"), versionNumberField, versionRulesField)
+	cursor, err := a.database.Query(context.Background(), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	versions := []Version{}
+	for {
+		var v Version
+		_, err := cursor.ReadDocument(context.Background(), &v)
+		if arango.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// DiffVersions returns rules of version from missing in version to (removed) and rules of
+// version to missing in version from (added).
+func (a *adapter) DiffVersions(from int, to int) ([]PolicyRule, []PolicyRule, error) {
+	removed, added, err := a.diffVersions(from, to)
+	return removed, added, wrapError(LoadOperation, "", nil, err)
+}
+
+func (a *adapter) diffVersions(from int, to int) ([]PolicyRule, []PolicyRule, error) {
+	if a.versionsName == "" {
+		return nil, nil, ErrVersioningOff
+	}
+	if err := a.ensureReady(); err != nil {
+		return nil, nil, err
+	}
+	vFrom, err := a.version(context.Background(), from)
+	if err != nil {
+		return nil, nil, err
+	}
+	vTo, err := a.version(context.Background(), to)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, added := diffRules(vFrom.Rules, vTo.Rules)
+	return removed, added, nil
+}
+
+// RestoreVersion atomically replaces stored rules with rules of given version, together with
+// their validity windows; rules whose validity has ended are skipped. Restored rules are recorded
+// as new version so restore itself may be undone.
+func (a *adapter) RestoreVersion(number int) error {
+	return wrapError(SaveOperation, "", nil, a.restoreVersion(number))
+}
+
+func (a *adapter) restoreVersion(number int) error {
+	if a.versionsName == "" {
+		return ErrVersioningOff
+	}
+	if err := a.ensureReady(); err != nil {
+		return err
+	}
+	v, err := a.version(context.Background(), number)
+	if err != nil {
+		return err
+	}
+	lines := make([]policyLine, 0, len(v.Rules))
+	rules := make([]PolicyRule, 0, len(v.Rules))
+	now := time.Now()
+	for _, r := range v.Rules {
+		// grants that have ended since version has been recorded are not brought back
+		if r.ValidUntil != nil && !r.ValidUntil.After(now) {
+			continue
+		}
+		lines = append(lines, policyLine{sec: r.Sec, ptype: r.PType, rule: r.Rule})
+		rules = append(rules, r)
+	}
+	var validity map[string]interface{}
+	if a.validity {
+		validity = a.rulesValidity(rules)
+	}
+	return a.saveLines(lines, validity)
+}